@@ -0,0 +1,616 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/hanjos/mea-libris/app"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+)
+
+// minPasswordLength is the shortest password accepted for an account.
+const minPasswordLength = 8
+
+// accountUsernamePattern matches valid account usernames.
+var accountUsernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,64}$`)
+
+// dummyPasswordHash is compared against when logging in with an unknown username, so that it takes as long as with a
+// known one, and usernames can't be found out by timing.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// accountService handles the /account endpoints: signing up, logging in and out, with a password or through OIDC,
+// and showing the current account. Once logged in, the user's provider connections are kept in their account,
+// server-side, instead of in their session, so they stay connected from any browser or device.
+type accountService struct {
+	registry    *app.Registry
+	allowSignup bool
+
+	// nil if OIDC login is disabled
+	oidc *oidcLogin
+	// nil if webhooks are disabled
+	webhooks *app.WebhookSender
+}
+
+func newAccountService(registry *app.Registry, allowSignup bool, oidc *oidcLogin, webhooks *app.WebhookSender) *accountService {
+	return &accountService{
+		registry:    registry,
+		allowSignup: allowSignup,
+		oidc:        oidc,
+		webhooks:    webhooks,
+	}
+}
+
+// Mount routes the account endpoints in the given mux, through wrap.
+func (as *accountService) Mount(mux *http.ServeMux, wrap func(http.Handler) http.Handler) {
+	mux.Handle("/account", wrap(app.Handler(as.HandleAccount)))
+	mux.Handle("/account/signup", wrap(app.Handler(as.HandleSignup)))
+	mux.Handle("/account/login", wrap(app.Handler(as.HandleLogin)))
+	mux.Handle("/account/logout", wrap(app.Handler(as.HandleLogout)))
+	mux.Handle("/account/csrf", wrap(app.Handler(as.HandleCSRFToken)))
+	mux.Handle("/account/link", wrap(app.Handler(as.HandleLink)))
+	mux.Handle("/account/tokens", wrap(app.Handler(as.HandleAPITokens)))
+	mux.Handle("/account/tokens/revoke", wrap(app.Handler(as.HandleRevokeAPIToken)))
+	mux.Handle("/account/webhooks", wrap(app.Handler(as.HandleWebhooks)))
+	mux.Handle("/account/webhooks/delete", wrap(app.Handler(as.HandleDeleteWebhook)))
+	mux.Handle("/account/webhooks/deliveries", wrap(app.Handler(as.HandleWebhookDeliveries)))
+
+	if as.oidc != nil {
+		mux.Handle("/account/oidc/login", wrap(app.Handler(as.HandleOIDCLogin)))
+		mux.Handle(oidcCallbackPath, wrap(app.Handler(as.HandleOIDCCallback)))
+	}
+}
+
+// HandleAccount shows the current account, as JSON, with the providers it's connected to, and those connected to in
+// this session before logging in, which may be linked to it.
+func (as *accountService) HandleAccount(w http.ResponseWriter, r *http.Request) *app.Error {
+	a, ok := currentAccount(r)
+	if !ok {
+		return app.Wrap(errNotLoggedIn, http.StatusUnauthorized)
+	}
+
+	connections := []string{}
+	for provider := range a.Connections {
+		connections = append(connections, provider)
+	}
+	sort.Strings(connections)
+
+	unlinked := []string{}
+	for provider := range as.sessionConnections(r) {
+		unlinked = append(unlinked, provider)
+	}
+	sort.Strings(unlinked)
+
+	accountJSON, err := json.Marshal(struct {
+		Username    string    `json:"username"`
+		Password    bool      `json:"password"`
+		OIDC        bool      `json:"oidc"`
+		Connections []string  `json:"connections"`
+		Unlinked    []string  `json:"unlinked"`
+		Created     time.Time `json:"created"`
+	}{a.Username, a.PasswordHash != "", a.OIDCSubject != "", connections, unlinked, a.Created})
+	if err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	_, err = fmt.Fprintf(w, "%s", accountJSON)
+	if err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+// HandleSignup creates an account with the username and password in the POSTed form, and logs into it.
+func (as *accountService) HandleSignup(w http.ResponseWriter, r *http.Request) *app.Error {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return app.Wrap(errMethodNotAllowed(r.Method), http.StatusMethodNotAllowed)
+	}
+
+	if err := checkCSRFToken(r); err != nil {
+		return app.Wrap(err, http.StatusForbidden)
+	}
+
+	if !as.allowSignup {
+		return app.Wrap(errSignupDisabled, http.StatusForbidden)
+	}
+
+	username, password := r.PostFormValue("username"), r.PostFormValue("password")
+	if !accountUsernamePattern.MatchString(username) {
+		return app.Wrap(errInvalidUsername(username), http.StatusBadRequest)
+	} else if len(password) < minPasswordLength {
+		return app.Wrap(errPasswordTooShort, http.StatusBadRequest)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return app.Wrap(errCantCreateAccount(err), http.StatusBadRequest)
+	}
+
+	a := &app.Account{
+		ID:           randomID(),
+		Username:     username,
+		PasswordHash: string(hash),
+		Connections:  map[string]string{},
+		Created:      time.Now(),
+	}
+
+	if err := accounts.Create(a); err == app.ErrUsernameTaken {
+		return app.Wrap(err, http.StatusConflict)
+	} else if err != nil {
+		return app.Wrap(errCantCreateAccount(err), http.StatusInternalServerError)
+	}
+
+	logFrom(r.Context()).Infof("Account %s created", username)
+	if err := as.logIn(w, r, a); err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "Account created! Logged in as %s.\n", username)
+	return nil
+}
+
+// HandleLogin logs into the account with the username and password in the POSTed form.
+func (as *accountService) HandleLogin(w http.ResponseWriter, r *http.Request) *app.Error {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return app.Wrap(errMethodNotAllowed(r.Method), http.StatusMethodNotAllowed)
+	}
+
+	if err := checkCSRFToken(r); err != nil {
+		return app.Wrap(err, http.StatusForbidden)
+	}
+
+	username, password := r.PostFormValue("username"), r.PostFormValue("password")
+	a, ok, err := accounts.FindByUsername(username)
+	if err != nil {
+		return app.Wrap(errCantLoadAccount(err), http.StatusInternalServerError)
+	}
+
+	hash := dummyPasswordHash
+	if ok && a.PasswordHash != "" {
+		hash = []byte(a.PasswordHash)
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok || a.PasswordHash == "" {
+		logFrom(r.Context()).Warnf("Failed login for %s", username)
+		return app.Wrap(errInvalidCredentials, http.StatusUnauthorized)
+	}
+
+	if err := as.logIn(w, r, a); err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	fmt.Fprintf(w, "Logged in as %s!\n", a.Username)
+	return nil
+}
+
+// HandleLogout logs out of the current account. The account keeps its connections.
+func (as *accountService) HandleLogout(w http.ResponseWriter, r *http.Request) *app.Error {
+	if _, ok := currentAccount(r); !ok {
+		fmt.Fprintln(w, "User wasn't logged in. Nothing was done.")
+		return nil
+	}
+
+	cookieSessions{}.Save(w, r, map[string]string{"accountID": ""})
+
+	fmt.Fprintln(w, "Logged out!")
+	return nil
+}
+
+// HandleOIDCLogin starts logging in through the OIDC provider, redirecting to it.
+func (as *accountService) HandleOIDCLogin(w http.ResponseWriter, r *http.Request) *app.Error {
+	state, nonce := randomID(), randomID()
+
+	// XXX as with any OAuth flow, the code can only be exchanged with the same redirect URL
+	config := as.oidc.requestConfig(r)
+	cookieSessions{}.Save(w, r, map[string]string{
+		"oidcState":       state,
+		"oidcNonce":       nonce,
+		"oidcRedirectURL": config.RedirectURL,
+	})
+
+	logFrom(r.Context()).Info("Redirecting to the OIDC provider to log in")
+	http.Redirect(w, r, config.AuthCodeURL(state, oidc.Nonce(nonce)), http.StatusTemporaryRedirect)
+	return nil
+}
+
+// HandleOIDCCallback finishes logging in through the OIDC provider. The account linked to the user's OIDC subject is
+// logged into; if there's none, the account currently logged into gets linked to it, or else a new one is created.
+func (as *accountService) HandleOIDCCallback(w http.ResponseWriter, r *http.Request) *app.Error {
+	sessions := cookieSessions{}
+	state, nonce, redirectURL := sessions.Value(r, "oidcState"), sessions.Value(r, "oidcNonce"),
+		sessions.Value(r, "oidcRedirectURL")
+
+	// XXX state and nonce are one-time values; we won't need them after this function
+	sessions.Save(w, r, map[string]string{"oidcState": "", "oidcNonce": "", "oidcRedirectURL": ""})
+
+	if state == "" || r.FormValue("state") != state {
+		return app.Wrap(errInvalidOIDCState, http.StatusBadRequest)
+	} else if errMsg := r.FormValue("error"); errMsg != "" {
+		return app.Wrap(errOIDCLoginFailed(fmt.Errorf("%s", errMsg)), http.StatusUnauthorized)
+	}
+
+	claims, err := as.oidc.exchange(r.Context(), redirectURL, r.FormValue("code"), nonce)
+	if err != nil {
+		return app.Wrap(errOIDCLoginFailed(err), http.StatusUnauthorized)
+	}
+
+	a, ok, err := accounts.FindByOIDCSubject(claims.subject)
+	if err != nil {
+		return app.Wrap(errCantLoadAccount(err), http.StatusInternalServerError)
+	}
+
+	if !ok {
+		if current, loggedIn := currentAccount(r); loggedIn && current.OIDCSubject == "" {
+			logFrom(r.Context()).Infof("Linking account %s to its OIDC subject", current.Username)
+			current.OIDCSubject = claims.subject
+			a, err = current, accounts.Put(current)
+		} else {
+			a, err = createOIDCAccount(r.Context(), claims)
+		}
+
+		if err != nil {
+			return app.Wrap(errCantCreateAccount(err), http.StatusInternalServerError)
+		}
+	}
+
+	if err := as.logIn(w, r, a); err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	fmt.Fprintf(w, "Logged in as %s!\n", a.Username)
+	return nil
+}
+
+// logIn makes a the current account, in a new session: nothing from the old one is kept, except the connections made
+// in it before logging in, which aren't used while logged in, unless linked to the account through /account/link. The
+// new session's CSRF token is sent in the X-CSRF-Token header.
+func (as *accountService) logIn(w http.ResponseWriter, r *http.Request, a *app.Account) error {
+	logFrom(r.Context()).Infof("Logging in as %s", a.Username)
+
+	token := randomID()
+	values := map[string]string{"accountID": a.ID, csrfTokenKey: token}
+	for provider, value := range as.sessionConnections(r) {
+		values[sessionConnectionKey(provider)] = value
+	}
+
+	if err := (cookieSessions{}).Renew(w, r, values); err != nil {
+		return err
+	}
+
+	w.Header().Set(csrfTokenHeader, token)
+	return nil
+}
+
+// HandleLink moves the session's connection to the provider in the POSTed form, made before logging in, into the
+// current account, replacing the account's own connection to it, if any.
+func (as *accountService) HandleLink(w http.ResponseWriter, r *http.Request) *app.Error {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return app.Wrap(errMethodNotAllowed(r.Method), http.StatusMethodNotAllowed)
+	}
+
+	if err := checkCSRFToken(r); err != nil {
+		return app.Wrap(err, http.StatusForbidden)
+	}
+
+	a, ok := currentAccount(r)
+	if !ok {
+		return app.Wrap(errNotLoggedIn, http.StatusUnauthorized)
+	}
+
+	provider := r.PostFormValue("provider")
+	value, ok := as.sessionConnections(r)[provider]
+	if !ok {
+		return app.Wrap(errNothingToLink(provider), http.StatusBadRequest)
+	}
+
+	_, err := accounts.Update(a.ID, func(a *app.Account) {
+		a.Connections[provider] = value
+	})
+	if err != nil {
+		return app.Wrap(errCantSaveAccount(err), http.StatusInternalServerError)
+	}
+
+	logFrom(r.Context()).Infof("Linking account %s to this session's %s connection", a.Username, provider)
+	err = cookieSessions{}.Save(w, r, map[string]string{sessionConnectionKey(provider): ""})
+	if err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	fmt.Fprintf(w, "Linked %s to %s!\n", provider, a.Username)
+	return nil
+}
+
+// sessionConnections returns, by provider, the connections kept in the session, instead of in an account.
+func (as *accountService) sessionConnections(r *http.Request) map[string]string {
+	found := map[string]string{}
+	for _, p := range as.registry.Providers() {
+		if value := (cookieSessions{}).Value(r, sessionConnectionKey(p.Name())); value != "" {
+			found[p.Name()] = value
+		}
+	}
+
+	return found
+}
+
+// createOIDCAccount creates an account for a new OIDC subject, named after its preferred username or email, with a
+// suffix if that's taken.
+func createOIDCAccount(ctx context.Context, claims *oidcClaims) (*app.Account, error) {
+	username := strings.Map(func(c rune) rune {
+		if accountUsernamePattern.MatchString(string(c)) {
+			return c
+		}
+
+		return '-'
+	}, defaultTo(claims.preferredUsername, defaultTo(claims.email, "user")))
+
+	if len(username) > 48 {
+		username = username[:48]
+	}
+
+	a := &app.Account{
+		ID:          randomID(),
+		Username:    username,
+		OIDCSubject: claims.subject,
+		Connections: map[string]string{},
+		Created:     time.Now(),
+	}
+
+	for i := 0; ; i++ {
+		err := accounts.Create(a)
+		if err != app.ErrUsernameTaken || i >= 10 {
+			if err == nil {
+				logFrom(ctx).Infof("Account %s created through OIDC", a.Username)
+			}
+
+			return a, err
+		}
+
+		a.Username = username + "-" + randomID()[:6]
+	}
+}
+
+// CONNECTIONS
+
+// currentAccount returns the account the user is logged into, if any.
+func currentAccount(r *http.Request) (*app.Account, bool) {
+	if auth, ok := requestAPIToken(r); ok {
+		return auth.account, true
+	}
+
+	id := cookieSessions{}.Value(r, "accountID")
+	if id == "" {
+		return nil, false
+	}
+
+	a, ok, err := accounts.Get(id)
+	if err != nil {
+		logFrom(r.Context()).Error(errCantLoadAccount(err))
+		return nil, false
+	}
+
+	return a, ok
+}
+
+// connection returns what the user needs to reach the given provider (a token, a username...): from their account,
+// if they're logged in, or else from their session. Returns "" if they aren't connected, or if the request's API token
+// doesn't cover the provider.
+func connection(r *http.Request, provider string) string {
+	if auth, ok := requestAPIToken(r); ok && !auth.token.Allows(provider, "") {
+		return ""
+	}
+
+	if a, ok := currentAccount(r); ok {
+		return a.Connections[provider]
+	}
+
+	return cookieSessions{}.Value(r, sessionConnectionKey(provider))
+}
+
+// saveConnection keeps what the user needs to reach the given provider: in their account, if they're logged in, or
+// else in their session, which needs w. An empty value removes it.
+func saveConnection(w http.ResponseWriter, r *http.Request, provider, value string) error {
+	a, ok := currentAccount(r)
+	if !ok && w == nil {
+		return errNoSessionResponse
+	} else if !ok {
+		return cookieSessions{}.Save(w, r, map[string]string{sessionConnectionKey(provider): value})
+	}
+
+	_, err := accounts.Update(a.ID, func(a *app.Account) {
+		if value == "" {
+			delete(a.Connections, provider)
+		} else {
+			a.Connections[provider] = value
+		}
+	})
+	if err != nil {
+		return errCantSaveAccount(err)
+	}
+
+	return nil
+}
+
+func sessionConnectionKey(provider string) string {
+	return provider + "Connection"
+}
+
+// accountTokens implements app.TokenStore, keeping OAuth tokens as connections.
+type accountTokens struct{}
+
+// Token implements the app.TokenStore interface.
+func (accountTokens) Token(r *http.Request, provider string) string {
+	return connection(r, provider)
+}
+
+// SaveToken implements the app.TokenStore interface.
+func (accountTokens) SaveToken(w http.ResponseWriter, r *http.Request, provider, token string) error {
+	return saveConnection(w, r, provider, token)
+}
+
+// CSRF TOKENS
+
+const (
+	// csrfTokenKey is where the session keeps its CSRF token.
+	csrfTokenKey = "csrfToken"
+	// csrfTokenHeader is where the CSRF token is sent, in requests and in responses.
+	csrfTokenHeader = "X-CSRF-Token"
+	// csrfTokenField is where the CSRF token may be sent in a form, instead.
+	csrfTokenField = "csrf_token"
+)
+
+// HandleCSRFToken returns, as JSON, the session's CSRF token, which every POST relying on the session must send back.
+// The session gets one if it has none.
+func (as *accountService) HandleCSRFToken(w http.ResponseWriter, r *http.Request) *app.Error {
+	token := cookieSessions{}.Value(r, csrfTokenKey)
+	if token == "" {
+		token = randomID()
+		if err := (cookieSessions{}).Save(w, r, map[string]string{csrfTokenKey: token}); err != nil {
+			return app.Wrap(err, http.StatusInternalServerError)
+		}
+	}
+
+	tokenJSON, err := json.Marshal(struct {
+		Token string `json:"csrfToken"`
+	}{token})
+	if err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(csrfTokenHeader, token)
+	_, err = fmt.Fprintf(w, "%s", tokenJSON)
+	if err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+// checkCSRFToken checks that the request carries its session's CSRF token, in the X-CSRF-Token header or in the
+// csrf_token form field. Another site can't read it, so it can't forge requests riding on the user's session.
+func checkCSRFToken(r *http.Request) error {
+	want := cookieSessions{}.Value(r, csrfTokenKey)
+
+	got := r.Header.Get(csrfTokenHeader)
+	if got == "" {
+		got = r.PostFormValue(csrfTokenField)
+	}
+
+	if want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return errInvalidCSRFToken
+	}
+
+	return nil
+}
+
+// OIDC
+
+// oidcCallbackPath is where the OIDC provider sends the user back to.
+const oidcCallbackPath = "/account/oidc/callback"
+
+// oidcLogin logs users in through an OpenID Connect provider.
+type oidcLogin struct {
+	issuer   string
+	config   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	client   *http.Client
+}
+
+// oidcClaims are what's used from a verified ID token.
+type oidcClaims struct {
+	subject           string
+	email             string
+	preferredUsername string
+}
+
+// newOIDCLogin discovers the given issuer's endpoints and keys.
+func newOIDCLogin(ctx context.Context, issuer, clientID, clientSecret string, client *http.Client) (*oidcLogin, error) {
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, client), issuer)
+	if err != nil {
+		return nil, errCantDiscoverOIDCIssuer(issuer, err)
+	}
+
+	return &oidcLogin{
+		issuer: issuer,
+		config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+		client:   client,
+	}, nil
+}
+
+// requestConfig returns a copy of the OAuth config, with the redirect URL for the given request.
+func (o *oidcLogin) requestConfig(r *http.Request) *oauth2.Config {
+	config := *o.config
+	config.RedirectURL = originURL(r) + oidcCallbackPath
+
+	return &config
+}
+
+// exchange trades a code for an ID token, and returns its claims once it's verified and its nonce checked.
+func (o *oidcLogin) exchange(ctx context.Context, redirectURL, code, nonce string) (*oidcClaims, error) {
+	if code == "" {
+		return nil, errOIDCCodeNotFound
+	}
+
+	ctx = oidc.ClientContext(ctx, o.client)
+	config := *o.config
+	config.RedirectURL = redirectURL
+
+	token, err := config.Exchange(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errIDTokenNotFound
+	}
+
+	idToken, err := o.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	} else if idToken.Nonce != nonce {
+		return nil, errInvalidOIDCNonce
+	}
+
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	result := &oidcClaims{
+		subject:           idToken.Issuer + " " + idToken.Subject,
+		preferredUsername: claims.PreferredUsername,
+	}
+
+	if claims.EmailVerified {
+		result.email = claims.Email
+	}
+
+	return result, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/hanjos/mea-libris/app"
+)
+
+// browser sends requests to a handler, keeping the cookies it gets, as a browser would.
+type browser struct {
+	t       *testing.T
+	h       http.Handler
+	cookies map[string]*http.Cookie
+}
+
+// newAccountTest mounts the account endpoints, with the Google provider, webhooks and a memory account store, plus a
+// /connect endpoint which connects the session to Google with the given value. Returns a browser with no cookies yet.
+func newAccountTest(t *testing.T) *browser {
+	cfg = &Config{}
+
+	registry := app.NewRegistry()
+	if err := registry.Register(newGoogleProvider("client", "secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	old := accounts
+	accounts = app.NewMemoryAccountStore()
+	t.Cleanup(func() { accounts = old })
+
+	mux := http.NewServeMux()
+	webhooks := app.NewWebhookSender(http.DefaultClient, 0, logger)
+	newAccountService(registry, true, nil, webhooks).Mount(mux, func(h http.Handler) http.Handler { return h })
+	mux.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
+		cookieSessions{}.Save(w, r, map[string]string{sessionConnectionKey("google"): r.FormValue("value")})
+	})
+
+	return &browser{t: t, h: mux, cookies: map[string]*http.Cookie{}}
+}
+
+// do sends a request, with the given form if it's a POST, and the CSRF token if given.
+func (b *browser) do(method, path string, form url.Values, csrfToken string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if method == "POST" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	if csrfToken != "" {
+		r.Header.Set(csrfTokenHeader, csrfToken)
+	}
+
+	for _, c := range b.cookies {
+		r.AddCookie(c)
+	}
+
+	w := httptest.NewRecorder()
+	b.h.ServeHTTP(w, r)
+
+	for _, c := range w.Result().Cookies() {
+		b.cookies[c.Name] = c
+	}
+
+	return w
+}
+
+// csrfToken gets the session's CSRF token from /account/csrf.
+func (b *browser) csrfToken() string {
+	w := b.do("GET", "/account/csrf", nil, "")
+
+	var body struct {
+		Token string `json:"csrfToken"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		b.t.Fatal(err)
+	} else if body.Token == "" || w.Header().Get(csrfTokenHeader) != body.Token {
+		b.t.Fatalf("got the token %q, and %q in the header", body.Token, w.Header().Get(csrfTokenHeader))
+	}
+
+	return body.Token
+}
+
+func TestSessionCookie(t *testing.T) {
+	b := newAccountTest(t)
+
+	tests := []struct {
+		name   string
+		https  bool
+		secure bool
+	}{
+		{"HTTP", false, false},
+		{"HTTPS", true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/account/csrf", nil)
+			if test.https {
+				r = httptest.NewRequest("GET", "https://example.com/account/csrf", nil)
+			}
+
+			w := httptest.NewRecorder()
+			b.h.ServeHTTP(w, r)
+
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("got %d cookies, want 1", len(cookies))
+			}
+
+			c := cookies[0]
+			if !c.HttpOnly || c.SameSite != http.SameSiteLaxMode || c.Path != "/" || c.Secure != test.secure {
+				t.Errorf("got HttpOnly %t, SameSite %v, Path %q and Secure %t", c.HttpOnly, c.SameSite, c.Path, c.Secure)
+			}
+		})
+	}
+}
+
+func TestAccountCSRFToken(t *testing.T) {
+	form := url.Values{"username": {"me"}, "password": {"a password"}}
+
+	tests := []struct {
+		name   string
+		token  func(b *browser) string
+		status int
+	}{
+		{"no token", func(b *browser) string { b.csrfToken(); return "" }, http.StatusForbidden},
+		{"no session", func(b *browser) string { return "made-up" }, http.StatusForbidden},
+		{"another session's token", func(b *browser) string {
+			b.csrfToken()
+			other := &browser{t: t, h: b.h, cookies: map[string]*http.Cookie{}}
+			return other.csrfToken()
+		}, http.StatusForbidden},
+		{"the session's token", func(b *browser) string { return b.csrfToken() }, http.StatusCreated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newAccountTest(t)
+
+			w := b.do("POST", "/account/signup", form, test.token(b))
+			if w.Code != test.status {
+				t.Errorf("signing up: got status %d, want %d", w.Code, test.status)
+			}
+
+			if test.status == http.StatusCreated {
+				return
+			}
+
+			if _, ok, _ := accounts.FindByUsername("me"); ok {
+				t.Errorf("the account was created")
+			}
+
+			accounts.Create(&app.Account{ID: randomID(), Username: "me", PasswordHash: string(dummyPasswordHash)})
+			if w := b.do("POST", "/account/login", form, test.token(b)); w.Code != test.status {
+				t.Errorf("logging in: got status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestLogInRenewsTheSession(t *testing.T) {
+	b := newAccountTest(t)
+	b.do("POST", "/connect", url.Values{"value": {"their token"}}, "")
+
+	before := b.csrfToken()
+	w := b.do("POST", "/account/signup", url.Values{"username": {"me"}, "password": {"a password"}}, before)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	after := w.Header().Get(csrfTokenHeader)
+	if after == "" || after == before {
+		t.Errorf("got the CSRF token %q, after %q", after, before)
+	} else if got := b.csrfToken(); got != after {
+		t.Errorf("the session has the CSRF token %q, want %q", got, after)
+	}
+
+	if w := b.do("POST", "/account/link", url.Values{"provider": {"google"}}, before); w.Code != http.StatusForbidden {
+		t.Errorf("the old CSRF token: got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	// XXX connections from before logging in aren't moved into the account, but stay in the session to be linked
+	a, _, _ := accounts.FindByUsername("me")
+	if len(a.Connections) != 0 {
+		t.Errorf("the account got the connections %v", a.Connections)
+	}
+
+	var account struct {
+		Connections []string `json:"connections"`
+		Unlinked    []string `json:"unlinked"`
+	}
+	json.NewDecoder(b.do("GET", "/account", nil, "").Body).Decode(&account)
+	if len(account.Connections) != 0 || len(account.Unlinked) != 1 || account.Unlinked[0] != "google" {
+		t.Errorf("got the connections %q, and %q unlinked", account.Connections, account.Unlinked)
+	}
+}
+
+func TestLink(t *testing.T) {
+	b := newAccountTest(t)
+
+	w := b.do("POST", "/account/link", url.Values{"provider": {"google"}}, b.csrfToken())
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("logged out: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	b.do("POST", "/connect", url.Values{"value": {"their token"}}, "")
+	w = b.do("POST", "/account/signup", url.Values{"username": {"me"}, "password": {"a password"}}, b.csrfToken())
+	token := w.Header().Get(csrfTokenHeader)
+
+	steps := []struct {
+		name     string
+		provider string
+		status   int
+	}{
+		{"a provider without a connection", "import", http.StatusBadRequest},
+		{"the connection", "google", http.StatusOK},
+		{"again", "google", http.StatusBadRequest},
+	}
+
+	for _, step := range steps {
+		if w := b.do("POST", "/account/link", url.Values{"provider": {step.provider}}, token); w.Code != step.status {
+			t.Errorf("%s: got status %d, want %d", step.name, w.Code, step.status)
+		}
+	}
+
+	a, _, _ := accounts.FindByUsername("me")
+	if a.Connections["google"] != "their token" {
+		t.Errorf("got the connections %v", a.Connections)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/gddo/httputil"
+	"github.com/hanjos/mea-libris/app"
+)
+
+// apiTokenPrefix starts every API token, so they're easy to spot (e.g. by secret scanners) and tell from OAuth tokens.
+const apiTokenPrefix = "mlt_"
+
+// apiTokenFormats are the formats an API token may be limited to.
+var apiTokenFormats = []string{"json", "csv"}
+
+// apiTokenUseResolution is how often an API token's last use is recorded. Recording every single use would mean
+// rewriting the accounts file on every request.
+const apiTokenUseResolution = time.Minute
+
+// apiTokenAuth is what a request authenticated with an API token carries in its context.
+type apiTokenAuth struct {
+	account *app.Account
+	token   *app.APIToken
+}
+
+type apiTokenKey struct{}
+
+// requestAPIToken returns the API token the request was authenticated with, if any.
+func requestAPIToken(r *http.Request) (*apiTokenAuth, bool) {
+	auth, ok := r.Context().Value(apiTokenKey{}).(*apiTokenAuth)
+	return auth, ok
+}
+
+// withAPITokens lets requests with an "Authorization: Bearer <API token>" header read books as the token's account,
+// without a session. Such requests may only GET the books and changes endpoints of the providers the token covers, or
+// /library, in the formats it allows. Requests without the header go straight through.
+func withAPITokens(registry *app.Registry, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, ok := bearerToken(r)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		app.Handler(func(w http.ResponseWriter, r *http.Request) *app.Error {
+			a, token, ok, err := accounts.FindByAPIToken(hashAPIToken(raw))
+			if err != nil {
+				return app.Wrap(errCantLoadAccount(err), http.StatusInternalServerError)
+			} else if !ok {
+				logFrom(r.Context()).Warn(errInvalidAPIToken)
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				return app.Wrap(errInvalidAPIToken, http.StatusUnauthorized)
+			}
+
+			logFrom(r.Context()).Infof("Authenticated as %s, with the API token %s", a.Username, token.Name)
+			if r.Method != "GET" && r.Method != "HEAD" {
+				w.Header().Set("Allow", "GET, HEAD")
+				return app.Wrap(errMethodNotAllowed(r.Method), http.StatusMethodNotAllowed)
+			}
+
+			if err := checkAPITokenScope(registry, r, token); err != nil {
+				logFrom(r.Context()).Warn(err)
+				return app.Wrap(err, http.StatusForbidden)
+			}
+
+			if time.Since(token.LastUsed) >= apiTokenUseResolution {
+				touchAPIToken(r.Context(), a.ID, token.ID)
+			}
+
+			ctx := context.WithValue(r.Context(), apiTokenKey{}, &apiTokenAuth{account: a, token: token})
+			h.ServeHTTP(w, r.WithContext(ctx))
+			return nil
+		}).ServeHTTP(w, r)
+	})
+}
+
+// checkAPITokenScope returns an error if the token doesn't cover the requested endpoint or format. /library is
+// covered by every token, but only lists the providers the token covers.
+func checkAPITokenScope(registry *app.Registry, r *http.Request, token *app.APIToken) error {
+	format := bookFormat(r)
+	if r.URL.Path == "/library" {
+		if !token.Allows("", format) {
+			return errAPITokenNotAllowed(r.URL.Path, format)
+		}
+
+		return nil
+	}
+
+	// XXX books endpoints end with a slash, but are usually called without it
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	for _, p := range registry.Providers() {
+		feed, _ := p.(app.ChangeFeed)
+		if strings.TrimSuffix(p.Books(), "/") == path || (feed != nil && feed.Changes() == path) {
+			if !token.Allows(p.Name(), format) {
+				return errAPITokenNotAllowed(r.URL.Path, format)
+			}
+
+			return nil
+		}
+	}
+
+	return errAPITokenNotAllowed(r.URL.Path, "")
+}
+
+// touchAPIToken records that the given API token was just used. Failing that is logged, not reported, since the
+// request can go on just fine.
+func touchAPIToken(ctx context.Context, accountID, tokenID string) {
+	_, err := accounts.Update(accountID, func(a *app.Account) {
+		for i := range a.APITokens {
+			if a.APITokens[i].ID == tokenID {
+				a.APITokens[i].LastUsed = time.Now()
+			}
+		}
+	})
+	if err != nil {
+		logFrom(ctx).Error(errCantSaveAccount(err))
+	}
+}
+
+// bearerToken returns the API token in the request's Authorization header, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(auth[len("Bearer "):]), true
+}
+
+// hashAPIToken returns what's kept of an API token. Tokens are random enough that a plain hash is as good as bcrypt,
+// and can be looked up.
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bookFormat returns the format, json or csv, books will be sent in, as negotiated from the request's Accept header.
+func bookFormat(r *http.Request) string {
+	contentType := httputil.NegotiateContentType(r,
+		[]string{"application/json", "text/csv", "application/csv"},
+		"application/json")
+	if contentType == "text/csv" || contentType == "application/csv" {
+		return "csv"
+	}
+
+	return "json"
+}
+
+// apiTokenJSON is how API tokens are shown. The token itself is only there right after it's created.
+type apiTokenJSON struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Token     string     `json:"token,omitempty"`
+	Providers []string   `json:"providers"`
+	Formats   []string   `json:"formats"`
+	Created   time.Time  `json:"created"`
+	LastUsed  *time.Time `json:"lastUsed"`
+}
+
+func newAPITokenJSON(t *app.APIToken, token string) apiTokenJSON {
+	result := apiTokenJSON{
+		ID:        t.ID,
+		Name:      t.Name,
+		Token:     token,
+		Providers: defaultToSlice(t.Providers, []string{}),
+		Formats:   defaultToSlice(t.Formats, []string{}),
+		Created:   t.Created,
+	}
+
+	if !t.LastUsed.IsZero() {
+		lastUsed := t.LastUsed
+		result.LastUsed = &lastUsed
+	}
+
+	return result
+}
+
+// HandleAPITokens lists the current account's API tokens on GET, and creates one on POST, with the name in the form,
+// limited to the providers and formats in the provider and format form values (which may be repeated or
+// comma-separated; none means all). The new token is only shown in the response.
+func (as *accountService) HandleAPITokens(w http.ResponseWriter, r *http.Request) *app.Error {
+	a, ok := currentAccount(r)
+	if !ok {
+		return app.Wrap(errNotLoggedIn, http.StatusUnauthorized)
+	}
+
+	switch r.Method {
+	case "GET":
+		tokens := []apiTokenJSON{}
+		for i := range a.APITokens {
+			tokens = append(tokens, newAPITokenJSON(&a.APITokens[i], ""))
+		}
+
+		return writeJSON(w, http.StatusOK, tokens)
+	case "POST":
+		if err := checkCSRFToken(r); err != nil {
+			return app.Wrap(err, http.StatusForbidden)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		return app.Wrap(errMethodNotAllowed(r.Method), http.StatusMethodNotAllowed)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return app.Wrap(err, http.StatusBadRequest)
+	}
+
+	name := strings.TrimSpace(r.PostForm.Get("name"))
+	if name == "" {
+		return app.Wrap(errAPITokenNameNotFound, http.StatusBadRequest)
+	}
+
+	var names []string
+	for _, p := range as.registry.Providers() {
+		names = append(names, p.Name())
+	}
+
+	providers, err := splitValues("provider", r.PostForm["provider"], names)
+	if err != nil {
+		return app.Wrap(err, http.StatusBadRequest)
+	}
+
+	formats, err := splitValues("format", r.PostForm["format"], apiTokenFormats)
+	if err != nil {
+		return app.Wrap(err, http.StatusBadRequest)
+	}
+
+	raw := apiTokenPrefix + randomID()
+	token := app.APIToken{
+		ID:        randomID()[:12],
+		Name:      name,
+		Hash:      hashAPIToken(raw),
+		Providers: providers,
+		Formats:   formats,
+		Created:   time.Now(),
+	}
+
+	ok, err = accounts.Update(a.ID, func(a *app.Account) {
+		a.APITokens = append(a.APITokens, token)
+	})
+	if err != nil {
+		return app.Wrap(errCantSaveAccount(err), http.StatusInternalServerError)
+	} else if !ok {
+		return app.Wrap(errNotLoggedIn, http.StatusUnauthorized)
+	}
+
+	logFrom(r.Context()).Infof("API token %s created for %s", name, a.Username)
+	return writeJSON(w, http.StatusCreated, newAPITokenJSON(&token, raw))
+}
+
+// HandleRevokeAPIToken revokes the current account's API token with the id in the POSTed form.
+func (as *accountService) HandleRevokeAPIToken(w http.ResponseWriter, r *http.Request) *app.Error {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return app.Wrap(errMethodNotAllowed(r.Method), http.StatusMethodNotAllowed)
+	} else if err := checkCSRFToken(r); err != nil {
+		return app.Wrap(err, http.StatusForbidden)
+	}
+
+	a, ok := currentAccount(r)
+	if !ok {
+		return app.Wrap(errNotLoggedIn, http.StatusUnauthorized)
+	}
+
+	id, revoked := r.PostFormValue("id"), false
+	_, err := accounts.Update(a.ID, func(a *app.Account) {
+		for i, t := range a.APITokens {
+			if t.ID == id {
+				a.APITokens = append(a.APITokens[:i], a.APITokens[i+1:]...)
+				revoked = true
+				return
+			}
+		}
+	})
+	if err != nil {
+		return app.Wrap(errCantSaveAccount(err), http.StatusInternalServerError)
+	} else if !revoked {
+		return app.Wrap(errAPITokenNotFound(id), http.StatusNotFound)
+	}
+
+	logFrom(r.Context()).Infof("API token %s revoked for %s", id, a.Username)
+	fmt.Fprintln(w, "API token revoked!")
+	return nil
+}
+
+// writeJSON sends v as JSON, with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) *app.Error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(status)
+	_, err = fmt.Fprintf(w, "%s", data)
+	if err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	return nil
+}
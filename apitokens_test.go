@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/hanjos/mea-libris/app"
+)
+
+// newAPITokenTest registers the Google, import and folder providers, and sets up an account holding the given token.
+// Returns the registry, and the raw token to send.
+func newAPITokenTest(t *testing.T, token app.APIToken) (*app.Registry, string) {
+	cfg = &Config{}
+
+	registry := app.NewRegistry()
+	for _, p := range []app.Provider{
+		newGoogleProvider("client", "secret"),
+		newImportProvider(app.NewMemoryBookStore()),
+		newFolderProvider(t.TempDir()),
+	} {
+		if err := registry.Register(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := accounts
+	accounts = app.NewMemoryAccountStore()
+	t.Cleanup(func() { accounts = old })
+
+	raw := apiTokenPrefix + randomID()
+	token.ID, token.Hash = randomID(), hashAPIToken(raw)
+	err := accounts.Create(&app.Account{ID: randomID(), Username: "me", APITokens: []app.APIToken{token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return registry, raw
+}
+
+func TestCheckAPITokenScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		providers []string
+		formats   []string
+		path      string
+		accept    string
+		allowed   bool
+	}{
+		{"any provider, books", nil, nil, "/google/", "", true},
+		{"any provider, books without a slash", nil, nil, "/google", "", true},
+		{"any provider, changes", nil, nil, "/google/changes", "", true},
+		{"any provider, another provider", nil, nil, "/import/", "text/csv", true},
+		{"any provider, library", nil, nil, "/library", "", true},
+		{"provider, its books", []string{"google"}, nil, "/google/", "", true},
+		{"provider, another provider's books", []string{"google"}, nil, "/folder/", "", false},
+		{"provider, library", []string{"folder"}, nil, "/library", "", true},
+		{"format, in it", nil, []string{"csv"}, "/google/", "text/csv", true},
+		{"format, in another", nil, []string{"csv"}, "/google/", "application/json", false},
+		{"format, in the default", nil, []string{"csv"}, "/google/", "", false},
+		{"format, library in another", nil, []string{"json"}, "/library", "text/csv", false},
+		{"connecting", nil, nil, "/google/connect", "", false},
+		{"disconnecting", nil, nil, "/google/disconnect", "", false},
+		{"the account", nil, nil, "/account/", "", false},
+		{"API tokens", nil, nil, "/account/tokens", "", false},
+		{"unknown", nil, nil, "/nowhere", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := &app.APIToken{Providers: test.providers, Formats: test.formats}
+			registry, _ := newAPITokenTest(t, *token)
+
+			r := httptest.NewRequest("GET", test.path, nil)
+			if test.accept != "" {
+				r.Header.Set("Accept", test.accept)
+			}
+
+			err := checkAPITokenScope(registry, r, token)
+			if test.allowed && err != nil {
+				t.Errorf("got the error %v", err)
+			} else if !test.allowed && err == nil {
+				t.Errorf("got no error")
+			}
+		})
+	}
+}
+
+func TestWithAPITokens(t *testing.T) {
+	registry, raw := newAPITokenTest(t, app.APIToken{Name: "script", Providers: []string{"google"}})
+
+	var reached *http.Request
+	h := withAPITokens(registry, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = r
+	}))
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		authorization string
+		status        int
+		authenticated bool
+	}{
+		{"no token", "GET", "/google/", "", http.StatusOK, false},
+		{"other authorization", "GET", "/google/", "Basic bWU6c2VjcmV0", http.StatusOK, false},
+		{"token", "GET", "/google/", "Bearer " + raw, http.StatusOK, true},
+		{"token, case-insensitive scheme", "HEAD", "/google/changes", "bearer " + raw, http.StatusOK, true},
+		{"invalid token", "GET", "/google/", "Bearer " + apiTokenPrefix + "nope", http.StatusUnauthorized, false},
+		{"POST", "POST", "/google/", "Bearer " + raw, http.StatusMethodNotAllowed, false},
+		{"out of scope", "GET", "/import/", "Bearer " + raw, http.StatusForbidden, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reached = nil
+
+			r := httptest.NewRequest(test.method, test.path, nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d", w.Code, test.status)
+			}
+
+			if test.status != http.StatusOK {
+				if reached != nil {
+					t.Errorf("the request went through")
+				}
+
+				return
+			} else if reached == nil {
+				t.Fatal("the request didn't go through")
+			}
+
+			auth, ok := requestAPIToken(reached)
+			if ok != test.authenticated {
+				t.Errorf("got authenticated %t, want %t", ok, test.authenticated)
+			} else if ok && (auth.account.Username != "me" || auth.token.Name != "script") {
+				t.Errorf("authenticated as %s, with the token %s", auth.account.Username, auth.token.Name)
+			}
+		})
+	}
+}
+
+func TestAPITokensCSRFToken(t *testing.T) {
+	b := newAccountTest(t)
+	w := b.do("POST", "/account/signup", url.Values{"username": {"me"}, "password": {"a password"}}, b.csrfToken())
+	token := w.Header().Get(csrfTokenHeader)
+
+	tokens := func() int {
+		a, _, _ := accounts.FindByUsername("me")
+		return len(a.APITokens)
+	}
+
+	w = b.do("POST", "/account/tokens", url.Values{"name": {"script"}}, "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("creating without a token: got status %d, want %d", w.Code, http.StatusForbidden)
+	} else if tokens() != 0 {
+		t.Errorf("got %d API tokens, want none", tokens())
+	}
+
+	w = b.do("POST", "/account/tokens", url.Values{"name": {"script"}}, token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating: got status %d: %s", w.Code, w.Body)
+	}
+
+	a, _, _ := accounts.FindByUsername("me")
+	id := a.APITokens[0].ID
+
+	w = b.do("POST", "/account/tokens/revoke", url.Values{"id": {id}}, "made-up")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("revoking with another token: got status %d, want %d", w.Code, http.StatusForbidden)
+	} else if tokens() != 1 {
+		t.Errorf("got %d API tokens, want 1", tokens())
+	}
+
+	if w := b.do("POST", "/account/tokens/revoke", url.Values{"id": {id}}, token); w.Code != http.StatusOK {
+		t.Errorf("revoking: got status %d: %s", w.Code, w.Body)
+	} else if tokens() != 0 {
+		t.Errorf("got %d API tokens, want none", tokens())
+	}
+}
@@ -0,0 +1,310 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUsernameTaken is returned when creating an account whose username is already in use.
+var ErrUsernameTaken = errors.New("Username already taken.")
+
+// Account is a user of this instance, who may log in with a password or through OIDC. Whatever the user needs to
+// reach each provider (an OAuth token, a username...) is kept in Connections, by provider name, so they stay
+// connected from any browser or device.
+type Account struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+
+	// A bcrypt hash of the password. Empty for accounts which log in through OIDC only.
+	PasswordHash string `json:"passwordHash,omitempty"`
+	// The OIDC issuer and subject, separated by a space. Empty for accounts which log in with a password only.
+	OIDCSubject string `json:"oidcSubject,omitempty"`
+
+	Connections map[string]string `json:"connections,omitempty"`
+	APITokens   []APIToken        `json:"apiTokens,omitempty"`
+	Webhooks    []Webhook         `json:"webhooks,omitempty"`
+	Created     time.Time         `json:"created"`
+}
+
+// APIToken lets scripts read an account's books without a browser session. Tokens are read-only, and may be limited
+// to some providers and formats. Only a hash of the token is kept, so it can't be shown again after it's created.
+type APIToken struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+
+	// The providers whose books may be read. Empty means all of them.
+	Providers []string `json:"providers,omitempty"`
+	// The formats (json, csv) the books may be read in. Empty means all of them.
+	Formats []string `json:"formats,omitempty"`
+
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// Webhook is a URL which is told whenever the account's books change. Payloads are signed with the secret, so the
+// receiver can tell they're genuine; unlike API tokens, it's kept as is, since signing needs it.
+type Webhook struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Secret  string    `json:"secret"`
+	Created time.Time `json:"created"`
+}
+
+// Allows returns true if the token may read books from the given provider, in the given format. Empty values aren't
+// checked.
+func (t *APIToken) Allows(provider, format string) bool {
+	return (provider == "" || allowedBy(t.Providers, provider)) && (format == "" || allowedBy(t.Formats, format))
+}
+
+// allowedBy returns true if value is in allowed, or if allowed is empty.
+func allowedBy(allowed []string, value string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, a := range allowed {
+		if a == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// copy returns a copy of a, which can be modified without touching a.
+func (a *Account) copy() *Account {
+	c := *a
+	c.Connections = map[string]string{}
+	for provider, value := range a.Connections {
+		c.Connections[provider] = value
+	}
+
+	c.APITokens = append([]APIToken(nil), a.APITokens...)
+	c.Webhooks = append([]Webhook(nil), a.Webhooks...)
+	return &c
+}
+
+// AccountStore keeps the accounts of this instance. Accounts returned are copies, so changes only stick after a Put.
+type AccountStore interface {
+	// Get returns the account with the given ID. The boolean is false if there's none.
+	Get(id string) (*Account, bool, error)
+
+	// List returns every account, sorted by username.
+	List() ([]*Account, error)
+
+	// FindByUsername returns the account with the given username, ignoring case. The boolean is false if there's none.
+	FindByUsername(username string) (*Account, bool, error)
+
+	// FindByOIDCSubject returns the account linked to the given OIDC subject. The boolean is false if there's none.
+	FindByOIDCSubject(subject string) (*Account, bool, error)
+
+	// FindByAPIToken returns the account with an API token with the given hash, and that token. The boolean is false if
+	// there's none.
+	FindByAPIToken(hash string) (*Account, *APIToken, bool, error)
+
+	// Create adds a new account. Returns ErrUsernameTaken if its username is already in use.
+	Create(a *Account) error
+
+	// Put replaces an existing account.
+	Put(a *Account) error
+
+	// Update changes the account with the given ID, with no other change to it happening in between. The boolean is
+	// false if there's no such account.
+	Update(id string, change func(a *Account)) (bool, error)
+}
+
+// accountStore keeps every account in memory and, if path isn't empty, in a JSON file too. There shouldn't be many
+// accounts in a single instance, so the whole file is rewritten on every change.
+type accountStore struct {
+	path string
+
+	mu       sync.RWMutex
+	accounts map[string]*Account
+}
+
+// NewMemoryAccountStore creates an app.AccountStore which keeps everything in memory, and so forgets it all on
+// restart.
+func NewMemoryAccountStore() AccountStore {
+	return &accountStore{accounts: map[string]*Account{}}
+}
+
+// NewFileAccountStore creates an app.AccountStore which keeps every account in the given JSON file, creating it (and
+// its directory) if needed.
+func NewFileAccountStore(path string) (AccountStore, error) {
+	s := &accountStore{path: path, accounts: map[string]*Account{}}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, os.MkdirAll(filepath.Dir(path), 0700)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var accounts []*Account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, err
+	}
+
+	for _, a := range accounts {
+		s.accounts[a.ID] = a
+	}
+
+	return s, nil
+}
+
+// Get implements the app.AccountStore interface.
+func (s *accountStore) Get(id string) (*Account, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	a, ok := s.accounts[id]
+	if !ok {
+		return nil, false, nil
+	}
+
+	return a.copy(), true, nil
+}
+
+// List implements the app.AccountStore interface.
+func (s *accountStore) List() ([]*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var accounts []*Account
+	for _, a := range s.accounts {
+		accounts = append(accounts, a.copy())
+	}
+
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Username < accounts[j].Username })
+	return accounts, nil
+}
+
+// FindByUsername implements the app.AccountStore interface.
+func (s *accountStore) FindByUsername(username string) (*Account, bool, error) {
+	return s.find(func(a *Account) bool { return strings.EqualFold(a.Username, username) })
+}
+
+// FindByOIDCSubject implements the app.AccountStore interface.
+func (s *accountStore) FindByOIDCSubject(subject string) (*Account, bool, error) {
+	return s.find(func(a *Account) bool { return a.OIDCSubject != "" && a.OIDCSubject == subject })
+}
+
+// FindByAPIToken implements the app.AccountStore interface.
+func (s *accountStore) FindByAPIToken(hash string) (*Account, *APIToken, bool, error) {
+	a, ok, err := s.find(func(a *Account) bool {
+		for _, t := range a.APITokens {
+			if t.Hash == hash {
+				return true
+			}
+		}
+
+		return false
+	})
+	if !ok || err != nil {
+		return nil, nil, ok, err
+	}
+
+	for i := range a.APITokens {
+		if a.APITokens[i].Hash == hash {
+			return a, &a.APITokens[i], true, nil
+		}
+	}
+
+	return nil, nil, false, nil
+}
+
+func (s *accountStore) find(match func(a *Account) bool) (*Account, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, a := range s.accounts {
+		if match(a) {
+			return a.copy(), true, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+// Create implements the app.AccountStore interface.
+func (s *accountStore) Create(a *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.accounts {
+		if strings.EqualFold(other.Username, a.Username) {
+			return ErrUsernameTaken
+		}
+	}
+
+	s.accounts[a.ID] = a.copy()
+	return s.save()
+}
+
+// Put implements the app.AccountStore interface.
+func (s *accountStore) Put(a *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.accounts[a.ID] = a.copy()
+	return s.save()
+}
+
+// Update implements the app.AccountStore interface.
+func (s *accountStore) Update(id string, change func(a *Account)) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.accounts[id]
+	if !ok {
+		return false, nil
+	}
+
+	a = a.copy()
+	change(a)
+	s.accounts[id] = a
+	return true, s.save()
+}
+
+// save writes every account to the file, if there's one. Must be called with the lock held.
+func (s *accountStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	accounts := []*Account{}
+	for _, a := range s.accounts {
+		accounts = append(accounts, a)
+	}
+
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// XXX writing to a temporary file first, so a crash doesn't leave a half-written file behind
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), "accounts-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -1,26 +1,77 @@
 /*
 Package app defines the different pieces of the application, which are all put together in main.
+
+Each source of books is an app.Provider: an app.Service handling the requests, routed by an app.Router. Providers are
+added to an app.Registry, which mounts their endpoints and reports their health, so main doesn't need to know about
+each one. Providers behind OAuth2 can build on app.OAuthProvider, which implements the whole authorization flow and
+only needs to be told how to fetch the books. Their tokens are kept in the session, unless an app.TokenStore is given;
+users with an app.Account, kept in an app.AccountStore, can have them kept server-side instead.
 */
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"golang.org/x/oauth2"
 )
 
 // Handler is an http.Handler which runs the given function and sends the data in *Error, if any, to http.Error, with
-// the proper status code.
+// the proper status code. The function should pass r.Context() on to whatever it calls, so that work is abandoned
+// when the client hangs up or a deadline set by Timeout expires.
 type Handler func(w http.ResponseWriter, r *http.Request) *Error
 
 // ServeHTTP implements the http.Handler interface.
 func (fn Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := fn(w, r); err != nil {
+		if r.Context().Err() == context.DeadlineExceeded {
+			err = &Error{err.Message, http.StatusGatewayTimeout}
+		}
+
 		http.Error(w, err.Message, err.Status)
 	}
 }
 
+// Timeout returns an http.Handler which runs h with a request context which expires after d. A non-positive d means
+// no deadline.
+func Timeout(d time.Duration, h http.Handler) http.Handler {
+	if d <= 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Logger is what this package logs through. *log.Logger is one, and so are most structured loggers.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx carrying the given logger, e.g. one which tags every line with the request's ID.
+// Whatever in this package is working on behalf of that context logs through it instead of its own.
+func WithLogger(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFrom returns the logger ctx carries, or fallback if it carries none.
+func LoggerFrom(ctx context.Context, fallback Logger) Logger {
+	if l, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return l
+	}
+
+	return fallback
+}
+
 // Error represents an error in processing, which will be returned from an app.Handler and converted into the
 // appropriate HTTP status code and message.
 type Error struct {
@@ -34,7 +85,7 @@ func (err *Error) Error() string {
 }
 
 // Wrap builds an app.Error from an error and status code. If err is nil or an *app.Error, it will be returned
-// unmodified.
+// unmodified. If err was caused by an expired deadline, the status will be 504 Gateway Timeout instead.
 func Wrap(err error, status int) *Error {
 	if err == nil {
 		return nil
@@ -44,6 +95,10 @@ func Wrap(err error, status int) *Error {
 		return appErr
 	}
 
+	if errors.Is(err, context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	}
+
 	appErr := &Error{err.Error(), status}
 
 	return appErr
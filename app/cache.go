@@ -0,0 +1,116 @@
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hanjos/mea-libris/libris"
+)
+
+// CacheEntry is a user's cached books, along with the validators used in conditional requests.
+type CacheEntry struct {
+	Books        libris.Books
+	ETag         string
+	LastModified time.Time
+	Expires      time.Time
+}
+
+// BookCache keeps each user's books in memory for a while, so repeated requests don't have to reach the provider
+// every time. Entries are keyed by user and by a variant string (e.g. the filters used to get the books). It is safe
+// for concurrent use.
+type BookCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]map[string]*CacheEntry
+}
+
+// NewBookCache creates a BookCache whose entries live for ttl. A non-positive ttl disables caching: nothing is ever
+// found.
+func NewBookCache(ttl time.Duration) *BookCache {
+	return &BookCache{
+		ttl:     ttl,
+		entries: map[string]map[string]*CacheEntry{},
+	}
+}
+
+// TTL returns how long the entries in this cache live.
+func (c *BookCache) TTL() time.Duration {
+	return c.ttl
+}
+
+// Get returns the unexpired entry for the given user and variant, if any.
+func (c *BookCache) Get(user, variant string) (*CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[user][variant]
+	if !ok {
+		return nil, false
+	}
+
+	if !time.Now().Before(entry.Expires) {
+		c.remove(user, variant)
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// Put stores books for the given user and variant, returning the new entry. If the books didn't change since the
+// last time they were stored, the entry keeps its old LastModified.
+func (c *BookCache) Put(user, variant string, books libris.Books) *CacheEntry {
+	now := time.Now()
+	entry := &CacheEntry{
+		Books:        books,
+		ETag:         books.ETag(),
+		LastModified: now.UTC().Truncate(time.Second), // XXX HTTP dates have no sub-second precision
+		Expires:      now.Add(c.ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.entries[user][variant]; ok && old.ETag == entry.ETag {
+		entry.LastModified = old.LastModified
+	}
+
+	if c.ttl <= 0 {
+		return entry
+	}
+
+	c.evictExpired(now)
+	if c.entries[user] == nil {
+		c.entries[user] = map[string]*CacheEntry{}
+	}
+
+	c.entries[user][variant] = entry
+	return entry
+}
+
+// Invalidate drops every entry for the given user.
+func (c *BookCache) Invalidate(user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, user)
+}
+
+// evictExpired drops every expired entry. Must be called with c.mu held.
+func (c *BookCache) evictExpired(now time.Time) {
+	for user, variants := range c.entries {
+		for variant, entry := range variants {
+			if !now.Before(entry.Expires) {
+				c.remove(user, variant)
+			}
+		}
+	}
+}
+
+// remove drops an entry, and its user if there's nothing left. Must be called with c.mu held.
+func (c *BookCache) remove(user, variant string) {
+	delete(c.entries[user], variant)
+	if len(c.entries[user]) == 0 {
+		delete(c.entries, user)
+	}
+}
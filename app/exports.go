@@ -0,0 +1,470 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExportTarget is where exported books are written to. Names are slash-separated paths, relative to the target's
+// root, e.g. "user/20240131T120000Z.csv".
+type ExportTarget interface {
+	// Put writes data under the given name, replacing whatever was there.
+	Put(ctx context.Context, name string, data []byte) error
+
+	// List returns the names directly inside the given directory, sorted. A missing directory is just empty.
+	List(ctx context.Context, dir string) ([]string, error)
+
+	// Delete removes the given name. Deleting what isn't there isn't an error.
+	Delete(ctx context.Context, name string) error
+
+	// String describes the target, without credentials.
+	String() string
+}
+
+// NewExportTarget returns the app.ExportTarget for the given location: a local directory (as a path or a file://
+// URL), a WebDAV collection (webdav:// or webdavs://, for HTTP or HTTPS) or an S3 bucket (s3://bucket/prefix). key and
+// secret are the WebDAV username and password, or the S3 access key ID and secret key. S3 buckets are reached at
+// endpoint, in region, with path-style URLs, so S3-compatible servers work too.
+func NewExportTarget(location, key, secret, endpoint, region string, client *http.Client) (ExportTarget, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme == "" || len(u.Scheme) == 1 { // XXX a one-letter scheme is a Windows drive
+		return NewDirExportTarget(location), nil
+	}
+
+	switch u.Scheme {
+	case "file":
+		return NewDirExportTarget(u.Path), nil
+	case "webdav", "webdavs":
+		scheme := "http"
+		if u.Scheme == "webdavs" {
+			scheme = "https"
+		}
+
+		return &webDAVTarget{
+			base:     &url.URL{Scheme: scheme, Host: u.Host, Path: strings.TrimRight(u.Path, "/")},
+			username: key,
+			password: secret,
+			client:   client,
+		}, nil
+	case "s3":
+		e, err := url.Parse(endpoint)
+		if err != nil || !e.IsAbs() || e.Host == "" {
+			return nil, fmt.Errorf("Invalid S3 endpoint %q", endpoint)
+		} else if u.Host == "" {
+			return nil, fmt.Errorf("No bucket in %q", location)
+		}
+
+		return &s3Target{
+			endpoint:  e,
+			bucket:    u.Host,
+			prefix:    strings.Trim(u.Path, "/"),
+			region:    region,
+			accessKey: key,
+			secretKey: secret,
+			client:    client,
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported export target %q: use a directory, webdav://, webdavs:// or s3://", location)
+	}
+}
+
+// DIRECTORY
+
+type dirTarget struct {
+	dir string
+}
+
+// NewDirExportTarget returns an app.ExportTarget which writes to the given local directory, creating it as needed.
+func NewDirExportTarget(dir string) ExportTarget {
+	return &dirTarget{dir: dir}
+}
+
+// Put implements the app.ExportTarget interface.
+func (t *dirTarget) Put(ctx context.Context, name string, data []byte) error {
+	file := filepath.Join(t.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	// XXX writing to a temporary file first, so a crash doesn't leave a half-written export behind
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".export-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+// List implements the app.ExportTarget interface.
+func (t *dirTarget) List(ctx context.Context, dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(t.dir, filepath.FromSlash(dir)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			names = append(names, info.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// Delete implements the app.ExportTarget interface.
+func (t *dirTarget) Delete(ctx context.Context, name string) error {
+	err := os.Remove(filepath.Join(t.dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// String implements the app.ExportTarget interface.
+func (t *dirTarget) String() string {
+	return t.dir
+}
+
+// WEBDAV
+
+type webDAVTarget struct {
+	base               *url.URL
+	username, password string
+	client             *http.Client
+}
+
+// Put implements the app.ExportTarget interface. Missing collections are created first.
+func (t *webDAVTarget) Put(ctx context.Context, name string, data []byte) error {
+	dirs := strings.Split(name, "/")
+	for i := 1; i < len(dirs); i++ {
+		// XXX 405 means the collection is already there
+		if err := t.do(ctx, "MKCOL", strings.Join(dirs[:i], "/")+"/", nil, nil, http.StatusMethodNotAllowed); err != nil {
+			return err
+		}
+	}
+
+	return t.do(ctx, "PUT", name, bytes.NewReader(data), nil)
+}
+
+// List implements the app.ExportTarget interface.
+func (t *webDAVTarget) List(ctx context.Context, dir string) ([]string, error) {
+	var result struct {
+		Responses []struct {
+			Href       string `xml:"href"`
+			Collection *struct {
+			} `xml:"propstat>prop>resourcetype>collection"`
+		} `xml:"response"`
+	}
+
+	body := `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`
+	err := t.do(ctx, "PROPFIND", strings.TrimSuffix(dir, "/")+"/", strings.NewReader(body), func(resp *http.Response) error {
+		return xml.NewDecoder(resp.Body).Decode(&result)
+	})
+	if isStatus(err, http.StatusNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, r := range result.Responses {
+		if r.Collection != nil {
+			continue
+		}
+
+		href, err := url.PathUnescape(r.Href)
+		if err != nil {
+			continue
+		}
+
+		names = append(names, path.Base(href))
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete implements the app.ExportTarget interface.
+func (t *webDAVTarget) Delete(ctx context.Context, name string) error {
+	return t.do(ctx, "DELETE", name, nil, nil, http.StatusNotFound)
+}
+
+// String implements the app.ExportTarget interface.
+func (t *webDAVTarget) String() string {
+	return t.base.String()
+}
+
+// do sends a request for the given name, and hands the response to read, if given. Besides 2xx, the given statuses
+// also count as success.
+func (t *webDAVTarget) do(ctx context.Context, method, name string, body io.Reader, read func(*http.Response) error, ok ...int) error {
+	u := *t.base
+	u.Path += "/" + name
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return err
+	}
+
+	if t.username != "" {
+		req.SetBasicAuth(t.username, t.password)
+	}
+
+	if method == "PROPFIND" {
+		req.Header.Set("Depth", "1")
+		req.Header.Set("Content-Type", "application/xml")
+	}
+
+	return doExportRequest(t.client, req.WithContext(ctx), read, ok...)
+}
+
+// S3
+
+type s3Target struct {
+	endpoint             *url.URL
+	bucket, prefix       string
+	region               string
+	accessKey, secretKey string
+	client               *http.Client
+}
+
+// Put implements the app.ExportTarget interface.
+func (t *s3Target) Put(ctx context.Context, name string, data []byte) error {
+	return t.do(ctx, "PUT", t.key(name), nil, data, nil)
+}
+
+// List implements the app.ExportTarget interface.
+func (t *s3Target) List(ctx context.Context, dir string) ([]string, error) {
+	prefix := t.key(strings.TrimSuffix(dir, "/")) + "/"
+
+	var names []string
+	continuation := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if continuation != "" {
+			query.Set("continuation-token", continuation)
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+
+		err := t.do(ctx, "GET", "", query, nil, func(resp *http.Response) error {
+			return xml.NewDecoder(resp.Body).Decode(&result)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			names = append(names, strings.TrimPrefix(c.Key, prefix))
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+
+		continuation = result.NextContinuationToken
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete implements the app.ExportTarget interface.
+func (t *s3Target) Delete(ctx context.Context, name string) error {
+	return t.do(ctx, "DELETE", t.key(name), nil, nil, nil, http.StatusNotFound)
+}
+
+// String implements the app.ExportTarget interface.
+func (t *s3Target) String() string {
+	return "s3://" + t.bucket + "/" + t.prefix + " at " + t.endpoint.String()
+}
+
+// key returns the object key for the given name.
+func (t *s3Target) key(name string) string {
+	if t.prefix == "" {
+		return name
+	}
+
+	return t.prefix + "/" + name
+}
+
+// do sends a signed, path-style request for the given key, and hands the response to read, if given. Besides 2xx,
+// the given statuses also count as success.
+func (t *s3Target) do(ctx context.Context, method, key string, query url.Values, body []byte, read func(*http.Response) error, ok ...int) error {
+	u := *t.endpoint
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + t.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+
+	u.RawPath = awsEscapePath(u.Path)
+	u.RawQuery = awsCanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	signAWSv4(req, body, t.accessKey, t.secretKey, t.region, time.Now())
+	return doExportRequest(t.client, req.WithContext(ctx), read, ok...)
+}
+
+// signAWSv4 signs req for S3, as per AWS Signature Version 4.
+func signAWSv4(req *http.Request, body []byte, accessKey, secretKey, region string, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + req.Header.Get("X-Amz-Content-Sha256"),
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape escapes s as AWS wants it: everything but unreserved characters, in uppercase hex.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// awsEscapePath escapes each segment of p with awsEscape.
+func awsEscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// awsCanonicalQuery encodes query sorted by key, with awsEscape.
+func awsCanonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// ERRORS
+
+// exportStatusError is a response with an unexpected status.
+type exportStatusError struct {
+	method, url string
+	status      int
+	body        string
+}
+
+// Error implements the error interface.
+func (e *exportStatusError) Error() string {
+	return fmt.Sprintf("%s %s: unexpected status %d %s", e.method, e.url, e.status, strings.TrimSpace(e.body))
+}
+
+// isStatus returns true if err is an unexpected response with the given status.
+func isStatus(err error, status int) bool {
+	e, ok := err.(*exportStatusError)
+	return ok && e.status == status
+}
+
+// doExportRequest sends req, and hands the response to read, if given. Besides 2xx, the given statuses also count as
+// success; read isn't called for those.
+func doExportRequest(client *http.Client, req *http.Request, read func(*http.Response) error, ok ...int) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if read != nil {
+			return read(resp)
+		}
+
+		return nil
+	}
+
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return &exportStatusError{method: req.Method, url: req.URL.String(), status: resp.StatusCode, body: string(body)}
+}
@@ -0,0 +1,549 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanjos/mea-libris/libris"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+)
+
+// tracer starts the spans of this package. They go nowhere unless a tracer provider is set with
+// otel.SetTracerProvider.
+var tracer = otel.Tracer("github.com/hanjos/mea-libris/app")
+
+// Sessions keeps values in the user's session, so the OAuth flow doesn't depend on how sessions are implemented.
+type Sessions interface {
+	// Value returns the value under key in the request's session, or "" if there's none.
+	Value(r *http.Request, key string) string
+
+	// Save sets the given values in the request's session and saves it. An empty value removes its key.
+	Save(w http.ResponseWriter, r *http.Request, values map[string]string) error
+}
+
+// TokenStore keeps users' OAuth tokens somewhere other than their sessions, e.g. in their accounts.
+type TokenStore interface {
+	// Token returns the request's user's token for the given provider, or "" if there's none.
+	Token(r *http.Request, provider string) string
+
+	// SaveToken keeps the request's user's token for the given provider. An empty token removes it. w is nil when
+	// there's no response to write to, e.g. when a token refreshed in ListBooks is kept.
+	SaveToken(w http.ResponseWriter, r *http.Request, provider, token string) error
+}
+
+// BookFetcher lists the user's books, given an *http.Client which is already authorized with their token.
+type BookFetcher func(r *http.Request, client *http.Client, token *oauth2.Token) (libris.Books, error)
+
+// BookEncoder writes books to a response, in whatever format the request asked for.
+type BookEncoder func(books libris.Books, w http.ResponseWriter, r *http.Request) error
+
+// OAuthProvider is an app.Provider for any source of books behind OAuth2. It implements the whole authorization code
+// flow: HandleConnect redirects the user to the OAuth server, HandleOAuthCallback exchanges the code it gets back for
+// a token, which is kept in the user's session, and HandleDisconnect revokes it. HandleBooks and ListBooks hand an
+// authorized *http.Client to the provider's BookFetcher.
+//
+// Providers with needs of their own can embed it and override whichever methods they must.
+type OAuthProvider struct {
+	Router
+	Client
+
+	name     string
+	sessions Sessions
+	fetch    BookFetcher
+
+	// RevokeURL is where tokens are revoked, as in RFC 7009: a POST with the token in the form's token parameter. If
+	// empty, disconnecting just forgets the token.
+	RevokeURL string
+
+	// RedirectURL returns the URL the OAuth server should send the user back to, which must route to
+	// HandleOAuthCallback. If nil, the one in the *oauth2.Config is used.
+	RedirectURL func(r *http.Request) string
+
+	// HTTPClient is used to talk to the OAuth server and, wrapped with the user's token, to fetch books. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Timeout bounds each call to the OAuth server, for the token exchange or revocation. A non-positive value means no
+	// timeout, other than the request's.
+	Timeout time.Duration
+
+	// Encode writes the books in HandleBooks. If nil, they're written as JSON.
+	Encode BookEncoder
+
+	// Tokens keeps the users' tokens. If nil, they're kept in their sessions.
+	Tokens TokenStore
+
+	// OnDisconnect, if given, is called with the user's token after they disconnect, e.g. to drop cached data.
+	OnDisconnect func(token *oauth2.Token)
+
+	// OnRefresh, if given, is called whenever an access token is refreshed, with the new token or what went wrong.
+	OnRefresh func(token *oauth2.Token, err error)
+
+	// Log receives a line for every step of the flow, unless the request carries a logger of its own; see WithLogger.
+	// May be nil.
+	Log Logger
+}
+
+// NewOAuthProvider creates an app.OAuthProvider with the given name, which also tells apart its values in the
+// session. Its endpoints come from router, its OAuth configuration from client, and its books from fetch.
+func NewOAuthProvider(name string, router Router, client Client, sessions Sessions, fetch BookFetcher) *OAuthProvider {
+	return &OAuthProvider{
+		Router:   router,
+		Client:   client,
+		name:     name,
+		sessions: sessions,
+		fetch:    fetch,
+	}
+}
+
+// Name implements the app.Provider interface.
+func (p *OAuthProvider) Name() string {
+	return p.name
+}
+
+// HandleBooks implements the app.Service interface, encoding whatever the provider's BookFetcher returns.
+func (p *OAuthProvider) HandleBooks(w http.ResponseWriter, r *http.Request) *Error {
+	bs, err := p.listBooks(w, r)
+	if err != nil {
+		return Wrap(err, http.StatusInternalServerError)
+	}
+
+	if p.Encode != nil {
+		return Wrap(p.Encode(bs, w, r), http.StatusInternalServerError)
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	return Wrap(bs.EncodeJSON(w), http.StatusInternalServerError)
+}
+
+// ListBooks implements the app.Lister interface. There's no response to write to, so a token refreshed along the way
+// can only be kept in the TokenStore, if there's one.
+func (p *OAuthProvider) ListBooks(r *http.Request) (libris.Books, error) {
+	return p.listBooks(nil, r)
+}
+
+// listBooks lists the user's books, keeping their token if it's refreshed along the way.
+func (p *OAuthProvider) listBooks(w http.ResponseWriter, r *http.Request) (libris.Books, error) {
+	token, err := p.Token(r)
+	if err != nil {
+		return nil, err
+	}
+
+	client, keep := p.RequestClient(r, token)
+	bs, err := p.fetch(r, client, token)
+	keep(w)
+
+	if err != nil {
+		return nil, Wrap(err, http.StatusInternalServerError)
+	}
+
+	return bs, nil
+}
+
+// HandleConnect implements the app.Service interface. If the user already has a token, there's nothing to do;
+// otherwise, they're redirected to the OAuth server, with a new state to be checked in HandleOAuthCallback.
+func (p *OAuthProvider) HandleConnect(w http.ResponseWriter, r *http.Request) *Error {
+	if _, err := p.Token(r); err == nil {
+		p.logf(r.Context(), "User authenticated and authorized.")
+		fmt.Fprintln(w, "Connected!") // XXX w.WriteHeader(http.StatusOK) is implicit
+		return nil
+	}
+
+	p.logf(r.Context(), "User not authorized; beginning auth exchange")
+	p.logf(r.Context(), "Generating a new state")
+	state, err := newState()
+	if err != nil {
+		return Wrap(err, http.StatusInternalServerError)
+	}
+
+	// XXX the code can only be exchanged with the same redirect URL, so the callback needs to know which one it was
+	config := p.requestConfig(r)
+	p.logf(r.Context(), "Setting the redirect URL to %s", config.RedirectURL)
+	p.sessions.Save(w, r, map[string]string{p.stateKey(): state, p.redirectURLKey(): config.RedirectURL})
+
+	p.logf(r.Context(), "Redirecting to %s's OAuth servers for a code", p.name)
+	http.Redirect(w, r, config.AuthCodeURL(state), http.StatusTemporaryRedirect)
+	return nil
+}
+
+// HandleOAuthCallback implements the app.Service interface, checking the state and exchanging the code for a token,
+// which is kept in the session. The user is then sent back to HandleConnect.
+func (p *OAuthProvider) HandleOAuthCallback(w http.ResponseWriter, r *http.Request) *Error {
+	p.logf(r.Context(), "Validating the state")
+	sessionState := p.sessions.Value(r, p.stateKey())
+	if sessionState == "" || r.FormValue("state") != sessionState {
+		return Wrap(errInvalidState(sessionState, r.FormValue("state")), http.StatusBadRequest)
+	}
+
+	p.logf(r.Context(), "Checking for errors")
+	if errMsg := r.FormValue("error"); errMsg != "" {
+		return Wrap(errCallbackError(errMsg), http.StatusUnauthorized)
+	}
+
+	p.logf(r.Context(), "Reading the code")
+	code := r.FormValue("code")
+	if code == "" {
+		return Wrap(errCodeNotFound, http.StatusBadRequest)
+	}
+
+	p.logf(r.Context(), "Exchanging the code for an access token")
+	ctx, cancel := p.callContext(r.Context())
+	defer cancel()
+
+	ctx, span := tracer.Start(ctx, "oauth.Exchange", trace.WithAttributes(attribute.String("oauth.provider", p.name)))
+	config := p.configWithRedirectURL(p.sessions.Value(r, p.redirectURLKey()))
+	token, err := config.Exchange(p.clientContext(ctx), code)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+
+	if err != nil {
+		return Wrap(errTokenExchangeError(err), http.StatusInternalServerError)
+	}
+
+	// XXX can't store an *oauth2.Token in the session, so it goes as JSON
+	tokenJSON, err := json.Marshal(token)
+	if err != nil {
+		return Wrap(errTokenExchangeError(err), http.StatusInternalServerError)
+	}
+
+	// XXX state is a one-time value; we won't need it after this function
+	p.sessions.Save(w, r, map[string]string{p.stateKey(): "", p.redirectURLKey(): ""})
+	if err := p.saveToken(w, r, string(tokenJSON)); err != nil {
+		return Wrap(errCantSaveToken(err), http.StatusInternalServerError)
+	}
+
+	p.logf(r.Context(), "Redirecting to %v to finish the auth process", p.Connect())
+	http.Redirect(w, r, p.Connect(), http.StatusTemporaryRedirect)
+	return nil
+}
+
+// HandleDisconnect implements the app.Service interface, revoking the user's tokens and forgetting them. The session
+// is reset even if revoking fails, since the user asked to be disconnected; the failure is then reported with a
+// 502 Bad Gateway.
+func (p *OAuthProvider) HandleDisconnect(w http.ResponseWriter, r *http.Request) *Error {
+	token, err := p.Token(r)
+	if err != nil {
+		p.logf(r.Context(), "User wasn't connected. Nothing was done.")
+		fmt.Fprintln(w, "User wasn't connected. Nothing was done.")
+		return nil
+	}
+
+	p.logf(r.Context(), "Disconnecting the current user")
+	revokeErr := p.revoke(r.Context(), token)
+
+	if p.OnDisconnect != nil {
+		p.OnDisconnect(token)
+	}
+
+	p.logf(r.Context(), "Resetting the session")
+	p.sessions.Save(w, r, map[string]string{p.stateKey(): "", p.redirectURLKey(): ""})
+	if err := p.saveToken(w, r, ""); err != nil {
+		return Wrap(errCantSaveToken(err), http.StatusInternalServerError)
+	}
+
+	if revokeErr != nil {
+		p.logf(r.Context(), "%v", revokeErr)
+		return Wrap(errDisconnectedWithoutRevoking(revokeErr), http.StatusBadGateway)
+	}
+
+	fmt.Fprintln(w, "User disconnected!")
+	return nil
+}
+
+// revoke revokes the refresh token, if there's one, and then the access token. Both are tried, even if the first
+// fails; the first error is returned, and any other is logged.
+func (p *OAuthProvider) revoke(ctx context.Context, token *oauth2.Token) error {
+	if p.RevokeURL == "" {
+		return nil
+	}
+
+	var firstErr error
+	for _, t := range []string{token.RefreshToken, token.AccessToken} {
+		if t == "" {
+			continue
+		}
+
+		if err := p.revokeToken(ctx, t); err != nil && firstErr == nil {
+			firstErr = err
+		} else if err != nil {
+			p.logf(ctx, "%v", err)
+		}
+	}
+
+	return firstErr
+}
+
+// revokeToken revokes a single token. A token the server says is invalid is taken as revoked already, which is what
+// happens to the access token after its refresh token is revoked, or once it expires.
+func (p *OAuthProvider) revokeToken(ctx context.Context, token string) error {
+	ctx, cancel := p.callContext(ctx)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", p.RevokeURL, strings.NewReader(url.Values{"token": {token}}.Encode()))
+	if err != nil {
+		return errCantRevokeToken(err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return errCantRevokeToken(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+
+	if json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&body) == nil && body.Error == "invalid_token" {
+		return nil
+	}
+
+	return errCantRevokeToken(errUnexpectedStatus(resp.Status))
+}
+
+// Token returns the user's token, from the TokenStore, if there's one, or from the session. A user without one gets a
+// 401 Unauthorized *app.Error.
+func (p *OAuthProvider) Token(r *http.Request) (*oauth2.Token, error) {
+	var tokenJSON string
+	if p.Tokens != nil {
+		tokenJSON = p.Tokens.Token(r, p.name)
+	} else {
+		tokenJSON = p.sessions.Value(r, p.tokenKey())
+	}
+
+	if tokenJSON == "" {
+		return nil, Wrap(errTokenNotFound(p.Connect()), http.StatusUnauthorized)
+	}
+
+	token := &oauth2.Token{}
+	if err := json.Unmarshal([]byte(tokenJSON), token); err != nil || token.AccessToken == "" {
+		return nil, Wrap(errTokenNotFound(p.Connect()), http.StatusUnauthorized)
+	}
+
+	return token, nil
+}
+
+// AuthClient returns an *http.Client which authorizes its requests with the given token, refreshing it as needed.
+// Whenever it's refreshed, OnRefresh is called, and then keep, if not nil, with the new token, so it can replace the
+// old one wherever that was kept. keep is called from whichever goroutine is making the request.
+func (p *OAuthProvider) AuthClient(ctx context.Context, token *oauth2.Token, keep func(token *oauth2.Token)) *http.Client {
+	// XXX the OAuth client wraps whatever client is in the context, so HTTPClient's transport goes under the token
+	// handling
+	ctx = p.clientContext(ctx)
+	if p.OnRefresh == nil && keep == nil {
+		return p.Config().Client(ctx, token)
+	}
+
+	// XXX the inner source has no access token, so it refreshes whenever it's asked, which the outer one only does
+	// once its token expires. Servers which don't send a new refresh token get the old one back, so the refreshed
+	// token can replace the old one
+	refresher := p.Config().TokenSource(ctx, &oauth2.Token{RefreshToken: token.RefreshToken})
+	return oauth2.NewClient(ctx, oauth2.ReuseTokenSource(token, refreshHook{refresher, p.OnRefresh, keep}))
+}
+
+// RequestClient returns an AuthClient for the request's user. The returned function keeps their token, if it was
+// refreshed, where Token finds it; it should be called once the client is done, before anything is written to the
+// response it's given. Without a response, i.e. with a nil one, the token is kept only if there's a TokenStore.
+func (p *OAuthProvider) RequestClient(r *http.Request, token *oauth2.Token) (*http.Client, func(w http.ResponseWriter)) {
+	var mu sync.Mutex
+	var refreshed *oauth2.Token
+
+	client := p.AuthClient(r.Context(), token, func(token *oauth2.Token) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		refreshed = token
+	})
+
+	return client, func(w http.ResponseWriter) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if refreshed == nil {
+			return
+		}
+
+		if err := p.keepToken(w, r, refreshed); err != nil {
+			p.logf(r.Context(), "%v", errCantSaveToken(err))
+		}
+
+		refreshed = nil
+	}
+}
+
+// keepToken keeps a refreshed token, like HandleOAuthCallback keeps a new one.
+func (p *OAuthProvider) keepToken(w http.ResponseWriter, r *http.Request, token *oauth2.Token) error {
+	if w == nil && p.Tokens == nil {
+		p.logf(r.Context(), "Not keeping the refreshed token; the session can't be saved without a response")
+		return nil
+	}
+
+	tokenJSON, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	p.logf(r.Context(), "Keeping the refreshed token")
+	return p.saveToken(w, r, string(tokenJSON))
+}
+
+// refreshHook calls functions whenever its source hands out a token, i.e. whenever it refreshes one: onRefresh with
+// whatever happened, and keep with the new token, if there is one. Either may be nil.
+type refreshHook struct {
+	source    oauth2.TokenSource
+	onRefresh func(token *oauth2.Token, err error)
+	keep      func(token *oauth2.Token)
+}
+
+// Token implements the oauth2.TokenSource interface.
+func (h refreshHook) Token() (*oauth2.Token, error) {
+	token, err := h.source.Token()
+	if h.onRefresh != nil {
+		h.onRefresh(token, err)
+	}
+
+	if err == nil && h.keep != nil {
+		h.keep(token)
+	}
+
+	return token, err
+}
+
+func (p *OAuthProvider) clientContext(ctx context.Context) context.Context {
+	if p.HTTPClient == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, oauth2.HTTPClient, p.HTTPClient)
+}
+
+// requestConfig returns a copy of the *oauth2.Config, with the redirect URL for the given request. The shared config
+// is never modified, since concurrent requests may need different redirect URLs.
+func (p *OAuthProvider) requestConfig(r *http.Request) *oauth2.Config {
+	if p.RedirectURL == nil {
+		return p.configWithRedirectURL("")
+	}
+
+	return p.configWithRedirectURL(p.RedirectURL(r))
+}
+
+// configWithRedirectURL returns a copy of the *oauth2.Config with the given redirect URL, or the config's own if
+// empty.
+func (p *OAuthProvider) configWithRedirectURL(redirectURL string) *oauth2.Config {
+	config := *p.Config()
+	if redirectURL != "" {
+		config.RedirectURL = redirectURL
+	}
+
+	return &config
+}
+
+// callContext returns a context for a call to the OAuth server, bounded by Timeout.
+func (p *OAuthProvider) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, p.Timeout)
+}
+
+func (p *OAuthProvider) httpClient() *http.Client {
+	if p.HTTPClient == nil {
+		return http.DefaultClient
+	}
+
+	return p.HTTPClient
+}
+
+// saveToken keeps the user's token in the TokenStore, if there's one, or in the session.
+func (p *OAuthProvider) saveToken(w http.ResponseWriter, r *http.Request, tokenJSON string) error {
+	if p.Tokens != nil {
+		return p.Tokens.SaveToken(w, r, p.name, tokenJSON)
+	}
+
+	return p.sessions.Save(w, r, map[string]string{p.tokenKey(): tokenJSON})
+}
+
+func (p *OAuthProvider) stateKey() string {
+	return p.name + "State"
+}
+
+func (p *OAuthProvider) redirectURLKey() string {
+	return p.name + "RedirectURL"
+}
+
+func (p *OAuthProvider) tokenKey() string {
+	return p.name + "Token"
+}
+
+func (p *OAuthProvider) logf(ctx context.Context, format string, v ...interface{}) {
+	if l := LoggerFrom(ctx, p.Log); l != nil {
+		l.Printf(format, v...)
+	}
+}
+
+// newState returns a random, unguessable state for an OAuth flow.
+func newState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func errInvalidState(expected, actual string) error {
+	return fmt.Errorf("Invalid state parameter: expected %s; got %s", expected, actual)
+}
+
+func errCallbackError(message string) error {
+	return fmt.Errorf("Callback received error: %v", message)
+}
+
+var errCodeNotFound = errors.New("Code not found.")
+
+func errTokenNotFound(connect string) error {
+	return fmt.Errorf("User not authorized. Use the %s endpoint.", connect)
+}
+
+func errTokenExchangeError(err error) error {
+	return fmt.Errorf("Problem with token exchange: %w", err)
+}
+
+func errCantRevokeToken(err error) error {
+	return fmt.Errorf("Failed to revoke token for the current user: %w", err)
+}
+
+func errCantSaveToken(err error) error {
+	return fmt.Errorf("Couldn't save the user's token: %w", err)
+}
+
+func errDisconnectedWithoutRevoking(err error) error {
+	return fmt.Errorf("User disconnected, but their access may still be valid: %w", err)
+}
+
+func errUnexpectedStatus(status string) error {
+	return fmt.Errorf("Unexpected response: %s", status)
+}
@@ -0,0 +1,173 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/hanjos/mea-libris/libris"
+	"golang.org/x/oauth2"
+)
+
+// testSessions keeps each user's session in memory, telling users apart by their session cookie.
+type testSessions struct {
+	mu       sync.Mutex
+	sessions map[string]map[string]string
+}
+
+func (s *testSessions) Value(r *http.Request, key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sessions[testSessionID(r)][key]
+}
+
+func (s *testSessions) Save(w http.ResponseWriter, r *http.Request, values map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := testSessionID(r)
+	if s.sessions[id] == nil {
+		s.sessions[id] = map[string]string{}
+	}
+
+	for key, value := range values {
+		if value == "" {
+			delete(s.sessions[id], key)
+		} else {
+			s.sessions[id][key] = value
+		}
+	}
+
+	return nil
+}
+
+func testSessionID(r *http.Request) string {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return ""
+	}
+
+	return c.Value
+}
+
+// callbackURL is where the test provider sends users on the given host back to.
+func callbackURL(host string) string {
+	return "http://" + host + "/test/oauth2callback"
+}
+
+func TestOAuthRedirectURLPerRequest(t *testing.T) {
+	// XXX the code given to each user is their host, so the token endpoint knows which redirect URL to expect
+	var mu sync.Mutex
+	exchanged := map[string]string{} // redirect_uri, by code
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		code := r.PostForm.Get("code")
+
+		mu.Lock()
+		exchanged[code] = r.PostForm.Get("redirect_uri")
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "token for " + code,
+			"token_type":   "Bearer",
+		})
+	}))
+	defer server.Close()
+
+	config := &oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   "https://auth.example.com/authorize",
+			TokenURL:  server.URL + "/token",
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+		RedirectURL: "http://default.example.com/test/oauth2callback",
+	}
+
+	sessions := &testSessions{sessions: map[string]map[string]string{}}
+	p := NewOAuthProvider("test", NewRouter("/test"), NewClient(config), sessions,
+		func(r *http.Request, client *http.Client, token *oauth2.Token) (libris.Books, error) {
+			return libris.Books{}, nil
+		})
+	p.HTTPClient = server.Client()
+	p.RedirectURL = func(r *http.Request) string {
+		return callbackURL(r.Host)
+	}
+
+	const users = 20
+
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		host := fmt.Sprintf("host%d.example.com", i)
+		session := &http.Cookie{Name: "session", Value: host}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r := httptest.NewRequest("GET", "http://"+host+"/test/connect", nil)
+			r.AddCookie(session)
+			w := httptest.NewRecorder()
+			if err := p.HandleConnect(w, r); err != nil {
+				t.Errorf("%s: connect: %v", host, err)
+				return
+			}
+
+			location, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Errorf("%s: connect: %v", host, err)
+				return
+			}
+
+			if got := location.Query().Get("redirect_uri"); got != callbackURL(host) {
+				t.Errorf("%s: redirected with redirect_uri %q, want %q", host, got, callbackURL(host))
+			}
+
+			callback := url.Values{"state": {location.Query().Get("state")}, "code": {host}}
+			r = httptest.NewRequest("GET", callbackURL(host)+"?"+callback.Encode(), nil)
+			r.AddCookie(session)
+			w = httptest.NewRecorder()
+			if err := p.HandleOAuthCallback(w, r); err != nil {
+				t.Errorf("%s: callback: %v", host, err)
+				return
+			}
+
+			r = httptest.NewRequest("GET", "http://"+host+"/test/", nil)
+			r.AddCookie(session)
+			token, err := p.Token(r)
+			if err != nil {
+				t.Errorf("%s: %v", host, err)
+			} else if token.AccessToken != "token for "+host {
+				t.Errorf("%s: got the token %q", host, token.AccessToken)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if len(exchanged) != users {
+		t.Errorf("got %d exchanges, want %d", len(exchanged), users)
+	}
+
+	for host, redirectURL := range exchanged {
+		if redirectURL != callbackURL(host) {
+			t.Errorf("%s: exchanged with redirect_uri %q, want %q", host, redirectURL, callbackURL(host))
+		}
+	}
+
+	if config.RedirectURL != "http://default.example.com/test/oauth2callback" {
+		t.Errorf("the shared config's redirect URL changed to %q", config.RedirectURL)
+	}
+}
@@ -0,0 +1,190 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/hanjos/mea-libris/libris"
+)
+
+// Provider is a source of books, which handles its own endpoints. Anything registered in an app.Registry will be
+// mounted by the server automatically.
+type Provider interface {
+	Service
+	Router
+
+	// Name identifies this provider, e.g. "google".
+	Name() string
+}
+
+// HealthChecker can be implemented by providers which are able to tell whether they're in working order.
+type HealthChecker interface {
+	// CheckHealth returns nil if everything's fine, or an error describing what's wrong.
+	CheckHealth(ctx context.Context) error
+}
+
+// ChangeFeed can be implemented by providers which are able to tell what changed in the user's books since an
+// earlier point, so clients can sync without fetching every book again.
+type ChangeFeed interface {
+	// Changes returns the path of the changes endpoint.
+	Changes() string
+
+	// HandleChanges sends what changed in the user's books.
+	HandleChanges(w http.ResponseWriter, r *http.Request) *Error
+}
+
+// Lister can be implemented by providers which are able to list the user's books without writing a response, so
+// books from several providers can be put together.
+type Lister interface {
+	// ListBooks returns the books HandleBooks would send for the same request. Errors should be *app.Error values, so
+	// that their status is kept; a user who isn't connected gets a 401 Unauthorized. Implementations must not modify
+	// the session, since other providers may be reading it at the same time.
+	ListBooks(r *http.Request) (libris.Books, error)
+}
+
+// Health describes the state of a single provider.
+type Health struct {
+	Name      string   `json:"name"`
+	Status    string   `json:"status"`
+	Error     string   `json:"error,omitempty"`
+	Endpoints []string `json:"endpoints"`
+}
+
+// Registry holds the providers available in the application, in registration order. It is safe for concurrent use.
+type Registry struct {
+	mu        sync.RWMutex
+	providers []Provider
+}
+
+// NewRegistry creates an empty app.Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds a provider to this registry. Names and endpoints must be unique, so mounting the providers doesn't
+// clash.
+func (reg *Registry) Register(p Provider) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for _, other := range reg.providers {
+		if other.Name() == p.Name() {
+			return fmt.Errorf("A provider named %s is already registered", p.Name())
+		}
+
+		for _, endpoint := range Endpoints(p) {
+			for _, otherEndpoint := range Endpoints(other) {
+				if endpoint == otherEndpoint {
+					return fmt.Errorf("Providers %s and %s both use the endpoint %s", other.Name(), p.Name(), endpoint)
+				}
+			}
+		}
+	}
+
+	reg.providers = append(reg.providers, p)
+	return nil
+}
+
+// Providers returns every registered provider, in registration order.
+func (reg *Registry) Providers() []Provider {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	return append([]Provider(nil), reg.providers...)
+}
+
+// Lookup returns the provider with the given name, if registered.
+func (reg *Registry) Lookup(name string) (Provider, bool) {
+	for _, p := range reg.Providers() {
+		if p.Name() == name {
+			return p, true
+		}
+	}
+
+	return nil, false
+}
+
+// Mount routes each provider's endpoints to its app.Service methods in the given mux. Every handler goes through wrap
+// first, so middlewares can be applied uniformly.
+func (reg *Registry) Mount(mux *http.ServeMux, wrap func(http.Handler) http.Handler) {
+	for _, p := range reg.Providers() {
+		mux.Handle(p.Books(), wrap(Handler(p.HandleBooks)))
+		mux.Handle(p.Connect(), wrap(Handler(p.HandleConnect)))
+		mux.Handle(p.Disconnect(), wrap(Handler(p.HandleDisconnect)))
+		mux.Handle(p.OAuthCallback(), wrap(Handler(p.HandleOAuthCallback)))
+
+		if feed, ok := p.(ChangeFeed); ok {
+			mux.Handle(feed.Changes(), wrap(Handler(feed.HandleChanges)))
+		}
+	}
+}
+
+// Health checks every provider which implements app.HealthChecker. Those which don't are assumed to be fine.
+func (reg *Registry) Health(ctx context.Context) []Health {
+	var result []Health
+	for _, p := range reg.Providers() {
+		h := Health{Name: p.Name(), Status: "ok", Endpoints: Endpoints(p)}
+
+		if checker, ok := p.(HealthChecker); ok {
+			if err := checker.CheckHealth(ctx); err != nil {
+				h.Status = "error"
+				h.Error = err.Error()
+			}
+		}
+
+		result = append(result, h)
+	}
+
+	return result
+}
+
+// Listing is a single provider's answer when asked for the user's books.
+type Listing struct {
+	Name  string
+	Books libris.Books
+	Err   error
+}
+
+// ListBooks asks every provider which implements app.Lister for the user's books, all at once, and returns their
+// answers in registration order. Providers which don't implement it are left out, as are those for which include, if
+// given, returns false.
+func (reg *Registry) ListBooks(r *http.Request, include func(p Provider) bool) []Listing {
+	var listers []Lister
+	var result []Listing
+	for _, p := range reg.Providers() {
+		if include != nil && !include(p) {
+			continue
+		}
+
+		if lister, ok := p.(Lister); ok {
+			listers = append(listers, lister)
+			result = append(result, Listing{Name: p.Name()})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, lister := range listers {
+		wg.Add(1)
+		go func(i int, lister Lister) {
+			defer wg.Done()
+
+			result[i].Books, result[i].Err = lister.ListBooks(r)
+		}(i, lister)
+	}
+
+	wg.Wait()
+	return result
+}
+
+// Endpoints returns every endpoint in the given app.Router, along with its changes endpoint, if it's an app.ChangeFeed
+// too.
+func Endpoints(r Router) []string {
+	endpoints := []string{r.Books(), r.Connect(), r.Disconnect(), r.OAuthCallback()}
+	if feed, ok := r.(ChangeFeed); ok {
+		endpoints = append(endpoints, feed.Changes())
+	}
+
+	return endpoints
+}
@@ -0,0 +1,181 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies lists the networks of the reverse proxies in front of the server, whose forwarding headers can be
+// believed. Those headers are ignored when coming from anyone else, since a client could send whatever it wanted.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies reads a comma-separated list of IP addresses and CIDR networks, e.g. "10.0.0.0/8, ::1". A *
+// trusts everyone, which is only safe when the server can't be reached without going through a proxy.
+func ParseTrustedProxies(s string) (TrustedProxies, error) {
+	var tp TrustedProxies
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "":
+			continue
+		case item == "*":
+			_, v4, _ := net.ParseCIDR("0.0.0.0/0")
+			_, v6, _ := net.ParseCIDR("::/0")
+			tp = append(tp, v4, v6)
+		case strings.Contains(item, "/"):
+			_, network, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid network %q", item)
+			}
+
+			tp = append(tp, network)
+		default:
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address %q", item)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			tp = append(tp, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+
+	return tp, nil
+}
+
+// Trusts returns true if the given address, with or without a port (as in http.Request.RemoteAddr), belongs to a
+// trusted proxy.
+func (tp TrustedProxies) Trusts(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	ip := net.ParseIP(strings.Trim(addr, "[]"))
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range tp {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Origin returns the scheme, host and path prefix the client used to reach the server. If the request came from a
+// trusted proxy, that's taken from the RFC 7239 Forwarded header or, failing that, from X-Forwarded-Proto,
+// X-Forwarded-Host and X-Forwarded-Prefix. Otherwise, the scheme depends on whether the connection is TLS, the host
+// is the request's, and there's no prefix.
+func (tp TrustedProxies) Origin(r *http.Request) (scheme, host, prefix string) {
+	scheme, host = "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if !tp.Trusts(r.RemoteAddr) {
+		return scheme, host, ""
+	}
+
+	if elements := forwardedElements(r.Header["Forwarded"]); len(elements) > 0 {
+		// XXX each proxy appends an element describing the request it got, so the rightmost one comes from the
+		// trusted peer, and the ones before it can be believed for as long as they were received from trusted proxies
+		for i := len(elements) - 1; i >= 0; i-- {
+			e := elements[i]
+			scheme = defaultToValid(e["proto"], scheme, validScheme)
+			host = defaultToValid(e["host"], host, validHost)
+
+			if !tp.Trusts(e["for"]) {
+				break
+			}
+		}
+	} else {
+		// XXX proxies are expected to set these, not to pass along whatever the client sent
+		scheme = defaultToValid(firstValue(r.Header.Get("X-Forwarded-Proto")), scheme, validScheme)
+		host = defaultToValid(firstValue(r.Header.Get("X-Forwarded-Host")), host, validHost)
+	}
+
+	prefix = firstValue(r.Header.Get("X-Forwarded-Prefix"))
+	if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "?#\\ ") {
+		prefix = ""
+	}
+
+	return scheme, host, strings.TrimRight(prefix, "/")
+}
+
+// forwardedElements parses the values of the Forwarded header, as per RFC 7239, into one map per element, keyed by
+// lowercase parameter name.
+func forwardedElements(values []string) []map[string]string {
+	var elements []map[string]string
+	for _, value := range values {
+		for _, element := range splitUnquoted(value, ',') {
+			e := map[string]string{}
+			for _, pair := range splitUnquoted(element, ';') {
+				i := strings.Index(pair, "=")
+				if i < 0 {
+					continue
+				}
+
+				key := strings.ToLower(strings.TrimSpace(pair[:i]))
+				e[key] = strings.Trim(strings.TrimSpace(pair[i+1:]), `"`)
+			}
+
+			elements = append(elements, e)
+		}
+	}
+
+	return elements
+}
+
+// splitUnquoted splits s around each sep which isn't inside a quoted string.
+func splitUnquoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// firstValue returns the first of a comma-separated list of values.
+func firstValue(s string) string {
+	if i := strings.Index(s, ","); i >= 0 {
+		s = s[:i]
+	}
+
+	return strings.TrimSpace(s)
+}
+
+func validScheme(s string) bool {
+	s = strings.ToLower(s)
+	return s == "http" || s == "https"
+}
+
+// validHost rejects anything which would change the meaning of a URL built with it.
+func validHost(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "/\\?#@ \t")
+}
+
+func defaultToValid(v, def string, valid func(string) bool) string {
+	if !valid(v) {
+		return def
+	}
+
+	return strings.ToLower(v)
+}
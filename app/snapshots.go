@@ -0,0 +1,199 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hanjos/mea-libris/libris"
+)
+
+// Snapshot is a user's books as they were at some point.
+type Snapshot struct {
+	ID    string       `json:"id"`
+	Taken time.Time    `json:"taken"`
+	ETag  string       `json:"etag"`
+	Books libris.Books `json:"books"`
+}
+
+// SnapshotStore keeps the latest snapshots of each user's books, so what changed since any of them can be told.
+// Users are keyed by whatever string the caller sees fit, e.g. including the filters used to get the books.
+type SnapshotStore interface {
+	// Record takes a snapshot of the user's books and returns it, unless they didn't change since the latest one,
+	// which is then returned instead. Older snapshots are dropped beyond the store's limit.
+	Record(user string, books libris.Books) (*Snapshot, error)
+
+	// Get returns the user's snapshot with the given ID. The boolean is false if there's none, e.g. if it was dropped.
+	Get(user, id string) (*Snapshot, bool, error)
+
+	// At returns the user's latest snapshot taken at or before t. The boolean is false if there's none.
+	At(user string, t time.Time) (*Snapshot, bool, error)
+}
+
+// snapshotStore keeps every user's snapshots in memory and, if dir isn't empty, as a JSON file per user too.
+type snapshotStore struct {
+	dir  string
+	keep int
+
+	mu        sync.Mutex
+	snapshots map[string][]*Snapshot // XXX oldest first
+}
+
+// NewMemorySnapshotStore creates an app.SnapshotStore which keeps up to keep snapshots per user, in memory, and so
+// forgets them all on restart.
+func NewMemorySnapshotStore(keep int) SnapshotStore {
+	return &snapshotStore{keep: keep, snapshots: map[string][]*Snapshot{}}
+}
+
+// NewFileSnapshotStore creates an app.SnapshotStore which keeps up to keep snapshots per user, as a JSON file per user
+// in the given directory, creating it if needed.
+func NewFileSnapshotStore(dir string, keep int) (SnapshotStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &snapshotStore{dir: dir, keep: keep, snapshots: map[string][]*Snapshot{}}, nil
+}
+
+// Record implements the app.SnapshotStore interface.
+func (s *snapshotStore) Record(user string, books libris.Books) (*Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshots, err := s.load(user)
+	if err != nil {
+		return nil, err
+	}
+
+	etag := books.ETag()
+	if n := len(snapshots); n > 0 && snapshots[n-1].ETag == etag {
+		return snapshots[n-1], nil
+	}
+
+	taken := time.Now().UTC()
+	if n := len(snapshots); n > 0 && !taken.After(snapshots[n-1].Taken) {
+		taken = snapshots[n-1].Taken.Add(time.Nanosecond) // XXX IDs come from the time, so they must not repeat
+	}
+
+	snapshot := &Snapshot{
+		ID:    strconv.FormatInt(taken.UnixNano(), 10),
+		Taken: taken,
+		ETag:  etag,
+		Books: books,
+	}
+
+	snapshots = append(snapshots, snapshot)
+	if len(snapshots) > s.keep {
+		snapshots = snapshots[len(snapshots)-s.keep:]
+	}
+
+	if err := s.save(user, snapshots); err != nil {
+		return nil, err
+	}
+
+	s.snapshots[user] = snapshots
+	return snapshot, nil
+}
+
+// Get implements the app.SnapshotStore interface.
+func (s *snapshotStore) Get(user, id string) (*Snapshot, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshots, err := s.load(user)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.ID == id {
+			return snapshot, true, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+// At implements the app.SnapshotStore interface.
+func (s *snapshotStore) At(user string, t time.Time) (*Snapshot, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshots, err := s.load(user)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !snapshots[i].Taken.After(t) {
+			return snapshots[i], true, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+// load returns the user's snapshots, reading them from their file the first time. Must be called with the lock held.
+func (s *snapshotStore) load(user string) ([]*Snapshot, error) {
+	if snapshots, ok := s.snapshots[user]; ok || s.dir == "" {
+		return snapshots, nil
+	}
+
+	data, err := ioutil.ReadFile(s.path(user))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*Snapshot
+	if err := json.Unmarshal(data, &snapshots); err != nil {
+		return nil, err
+	}
+
+	s.snapshots[user] = snapshots
+	return snapshots, nil
+}
+
+// save writes the user's snapshots to their file, if there's a directory. Must be called with the lock held.
+func (s *snapshotStore) save(user string, snapshots []*Snapshot) error {
+	if s.dir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(snapshots)
+	if err != nil {
+		return err
+	}
+
+	// XXX writing to a temporary file first, so a crash doesn't leave a half-written file behind
+	tmp, err := ioutil.TempFile(s.dir, "snapshots-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path(user))
+}
+
+// path returns the file holding the given user's snapshots. User names are hashed, so they're safe to use as file
+// names.
+func (s *snapshotStore) path(user string) string {
+	sum := sha256.Sum256([]byte(user))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
@@ -0,0 +1,147 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hanjos/mea-libris/libris"
+)
+
+// BookStore keeps books per user, for providers whose books can't be fetched from somewhere else on demand.
+type BookStore interface {
+	// Get returns the books stored for the given user. The boolean is false if there are none.
+	Get(user string) (libris.Books, bool, error)
+
+	// Put replaces the books stored for the given user.
+	Put(user string, books libris.Books) error
+
+	// Delete drops the books stored for the given user, if any.
+	Delete(user string) error
+}
+
+type memoryBookStore struct {
+	mu    sync.RWMutex
+	books map[string]libris.Books
+}
+
+// NewMemoryBookStore creates an app.BookStore which keeps everything in memory, and so forgets it all on restart.
+func NewMemoryBookStore() BookStore {
+	return &memoryBookStore{
+		books: map[string]libris.Books{},
+	}
+}
+
+// Get implements the app.BookStore interface.
+func (s *memoryBookStore) Get(user string) (libris.Books, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bs, ok := s.books[user]
+	return bs, ok, nil
+}
+
+// Put implements the app.BookStore interface.
+func (s *memoryBookStore) Put(user string, books libris.Books) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.books[user] = books
+	return nil
+}
+
+// Delete implements the app.BookStore interface.
+func (s *memoryBookStore) Delete(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.books, user)
+	return nil
+}
+
+type fileBookStore struct {
+	dir string
+	mu  sync.RWMutex
+}
+
+// NewFileBookStore creates an app.BookStore which keeps each user's books as a JSON file in the given directory,
+// creating it if needed.
+func NewFileBookStore(dir string) (BookStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &fileBookStore{dir: dir}, nil
+}
+
+// path returns the file holding the given user's books. User names are hashed, so they're safe to use as file names.
+func (s *fileBookStore) path(user string) string {
+	sum := sha256.Sum256([]byte(user))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Get implements the app.BookStore interface.
+func (s *fileBookStore) Get(user string) (libris.Books, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, err := ioutil.ReadFile(s.path(user))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	var bs libris.Books
+	if err := json.Unmarshal(data, &bs); err != nil {
+		return nil, false, err
+	}
+
+	return bs, true, nil
+}
+
+// Put implements the app.BookStore interface.
+func (s *fileBookStore) Put(user string, books libris.Books) error {
+	data, err := json.Marshal(books)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// XXX writing to a temporary file first, so a crash doesn't leave a half-written file behind
+	tmp, err := ioutil.TempFile(s.dir, "books-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path(user))
+}
+
+// Delete implements the app.BookStore interface.
+func (s *fileBookStore) Delete(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.Remove(s.path(user))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,193 @@
+package app
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RetryTransport is an http.RoundTripper which retries idempotent requests failing with network errors or transient
+// status codes (429 and 5xx), backing off exponentially with full jitter and honouring the Retry-After header. It also
+// limits how many requests per second go through it, so a burst of calls doesn't trip the provider's rate limits.
+type RetryTransport struct {
+	// Base is the underlying http.RoundTripper. Defaults to http.DefaultTransport.
+	Base http.RoundTripper
+
+	// MaxRetries is how many times a request will be retried before giving up.
+	MaxRetries int
+
+	// MinBackoff and MaxBackoff bound the time waited between attempts. A Retry-After header asking for longer than
+	// MaxBackoff is ignored.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Limiter throttles every attempt, retries included. May be nil, in which case there's no limit.
+	Limiter *rate.Limiter
+
+	// Log receives a line for every retry, unless the request's context carries a logger of its own; see WithLogger.
+	// May be nil.
+	Log Logger
+}
+
+// NewRetryTransport creates a RetryTransport over http.DefaultTransport, with sensible backoff bounds, which retries
+// at most maxRetries times and allows at most qps requests per second (no limit if qps <= 0).
+func NewRetryTransport(maxRetries int, qps float64, logger Logger) *RetryTransport {
+	var limiter *rate.Limiter
+	if qps > 0 {
+		limiter = rate.NewLimiter(rate.Limit(qps), int(qps)+1)
+	}
+
+	return &RetryTransport{
+		Base:       http.DefaultTransport,
+		MaxRetries: maxRetries,
+		MinBackoff: 250 * time.Millisecond,
+		MaxBackoff: 10 * time.Second,
+		Limiter:    limiter,
+		Log:        logger,
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if t.Limiter != nil {
+			if err := t.Limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		// XXX a consumed body must be rebuilt for every new attempt; that's done on a copy, since RoundTrip must not
+		// modify the caller's request
+		attemptReq := req
+		if attempt > 0 && req.Body != nil && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+
+			attemptReq = req.Clone(ctx)
+			attemptReq.Body = body
+		}
+
+		resp, err := base.RoundTrip(attemptReq)
+		if attempt >= t.MaxRetries || !isRetriable(req, resp, err) {
+			if attempt > 0 {
+				t.logf(ctx, "%s %s finished after %d retries", req.Method, req.URL.Path, attempt)
+			}
+
+			return resp, err
+		}
+
+		wait := t.backoff(attempt, resp)
+		t.logf(ctx, "%s %s failed (%s); retry %d of %d in %v", req.Method, req.URL.Path, describe(resp, err), attempt+1,
+			t.MaxRetries, wait)
+
+		if resp != nil {
+			// XXX draining the body, so the connection can be reused
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns how long to wait before the next attempt: whatever Retry-After says, if present and no longer than
+// MaxBackoff, or a random duration up to MinBackoff * 2^attempt, capped at MaxBackoff.
+func (t *RetryTransport) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if wait, ok := retryAfter(resp.Header.Get("Retry-After")); ok && wait <= t.MaxBackoff {
+			return wait
+		}
+	}
+
+	ceiling := t.MinBackoff << uint(attempt)
+	if ceiling <= 0 || ceiling > t.MaxBackoff {
+		ceiling = t.MaxBackoff
+	}
+
+	if ceiling <= t.MinBackoff {
+		return t.MinBackoff
+	}
+
+	return t.MinBackoff + time.Duration(rand.Int63n(int64(ceiling-t.MinBackoff)))
+}
+
+func (t *RetryTransport) logf(ctx context.Context, format string, v ...interface{}) {
+	if l := LoggerFrom(ctx, t.Log); l != nil {
+		l.Printf(format, v...)
+	}
+}
+
+// isRetriable returns true if req is idempotent and failed in a way that might not happen again.
+func isRetriable(req *http.Request, resp *http.Response, err error) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+	default:
+		return false
+	}
+
+	if req.Body != nil && req.GetBody == nil {
+		return false // can't send the body again
+	}
+
+	if err != nil {
+		return req.Context().Err() == nil // cancellations aren't transient
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfter parses a Retry-After header, which holds either a number of seconds or an HTTP date.
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		wait := date.Sub(time.Now())
+		if wait < 0 {
+			wait = 0
+		}
+
+		return wait, true
+	}
+
+	return 0, false
+}
+
+func describe(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+
+	return resp.Status
+}
@@ -0,0 +1,231 @@
+package app
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// flakyServer answers with each of statuses in turn, and then with 200 OK. Every response carries the given headers.
+// It keeps the body of every request it got.
+type flakyServer struct {
+	statuses []int
+	header   http.Header
+
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	s.mu.Lock()
+	attempt := len(s.bodies)
+	s.bodies = append(s.bodies, string(body))
+	s.mu.Unlock()
+
+	for key, values := range s.header {
+		w.Header()[key] = values
+	}
+
+	if attempt < len(s.statuses) {
+		w.WriteHeader(s.statuses[attempt])
+		return
+	}
+
+	io.WriteString(w, "ok")
+}
+
+func (s *flakyServer) attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.bodies)
+}
+
+func newTestRetryTransport(maxRetries int) *RetryTransport {
+	return &RetryTransport{
+		Base:       http.DefaultTransport,
+		MaxRetries: maxRetries,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+	}
+}
+
+func TestRetryTransportRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		statuses []int
+		status   int
+		attempts int
+	}{
+		{"success", "GET", nil, http.StatusOK, 1},
+		{"500, then success", "GET", []int{500}, http.StatusOK, 2},
+		{"502, 503 and 504, then success", "GET", []int{502, 503, 504}, http.StatusOK, 4},
+		{"429, then success", "GET", []int{429}, http.StatusOK, 2},
+		{"too many failures", "GET", []int{503, 503, 503, 503, 503}, http.StatusServiceUnavailable, 4},
+		{"404", "GET", []int{404}, http.StatusNotFound, 1},
+		{"501", "GET", []int{501}, http.StatusNotImplemented, 1},
+		{"POST isn't idempotent", "POST", []int{503}, http.StatusServiceUnavailable, 1},
+		{"DELETE is idempotent", "DELETE", []int{503}, http.StatusOK, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &flakyServer{statuses: test.statuses}
+			server := httptest.NewServer(s)
+			defer server.Close()
+
+			client := &http.Client{Transport: newTestRetryTransport(3)}
+			req, _ := http.NewRequest(test.method, server.URL, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != test.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, test.status)
+			}
+
+			if got := s.attempts(); got != test.attempts {
+				t.Errorf("got %d attempts, want %d", got, test.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryTransportRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		maxBackoff time.Duration
+		min, max   time.Duration
+	}{
+		{"in seconds", "1", 2 * time.Second, time.Second, 2 * time.Second},
+		{"as a date", time.Now().Add(3 * time.Second).UTC().Format(http.TimeFormat), 5 * time.Second,
+			time.Second, 4 * time.Second},
+		{"longer than MaxBackoff", "3600", 10 * time.Millisecond, 0, time.Second},
+		{"invalid", "soon", 10 * time.Millisecond, 0, time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &flakyServer{statuses: []int{http.StatusTooManyRequests}, header: http.Header{}}
+			s.header.Set("Retry-After", test.retryAfter)
+			server := httptest.NewServer(s)
+			defer server.Close()
+
+			transport := newTestRetryTransport(1)
+			transport.MaxBackoff = test.maxBackoff
+			client := &http.Client{Transport: transport}
+
+			start := time.Now()
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			elapsed := time.Since(start)
+
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("got status %d, want 200", resp.StatusCode)
+			}
+
+			if elapsed < test.min || elapsed > test.max {
+				t.Errorf("retried after %v, want between %v and %v", elapsed, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestRetryTransportResendsBody(t *testing.T) {
+	s := &flakyServer{statuses: []int{503, 503}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	req, _ := http.NewRequest("PUT", server.URL, strings.NewReader("the body"))
+	body := req.Body
+
+	resp, err := newTestRetryTransport(3).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if len(s.bodies) != 3 {
+		t.Fatalf("got %d attempts, want 3", len(s.bodies))
+	}
+
+	for i, got := range s.bodies {
+		if got != "the body" {
+			t.Errorf("attempt %d: got the body %q", i, got)
+		}
+	}
+
+	if req.Body != body {
+		t.Errorf("the caller's request got another body")
+	}
+}
+
+func TestRetryTransportBodyWithoutGetBody(t *testing.T) {
+	s := &flakyServer{statuses: []int{503}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	req, _ := http.NewRequest("PUT", server.URL, nil)
+	req.Body = io.NopCloser(bytes.NewReader([]byte("the body")))
+
+	resp, err := newTestRetryTransport(3).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable || s.attempts() != 1 {
+		t.Errorf("got status %d after %d attempts, want 503 after 1", resp.StatusCode, s.attempts())
+	}
+}
+
+func TestRetryTransportQPS(t *testing.T) {
+	s := &flakyServer{statuses: []int{503, 503}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	// XXX a burst of 1 at 20 per second: after the first, each attempt waits 50ms for its turn, retries included
+	transport := newTestRetryTransport(3)
+	transport.Limiter = rate.NewLimiter(20, 1)
+	client := &http.Client{Transport: transport}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	elapsed := time.Since(start)
+
+	if attempts := s.attempts(); attempts != 5 {
+		t.Fatalf("got %d attempts, want 5", attempts)
+	}
+
+	if want := 4 * 50 * time.Millisecond; elapsed < want {
+		t.Errorf("5 attempts took %v, want at least %v", elapsed, want)
+	}
+}
+
+func TestNewRetryTransportWithoutQPS(t *testing.T) {
+	if transport := NewRetryTransport(3, 0, nil); transport.Limiter != nil {
+		t.Errorf("got a limit of %v per second, want none", transport.Limiter.Limit())
+	}
+}
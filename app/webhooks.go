@@ -0,0 +1,292 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// WebhookDelivery is a single event sent to a webhook, and how sending it went.
+type WebhookDelivery struct {
+	ID      string    `json:"id"`
+	Webhook string    `json:"webhook"`
+	URL     string    `json:"url"`
+	Event   string    `json:"event"`
+	Created time.Time `json:"created"`
+
+	// One of pending (still being tried), delivered or failed (given up on).
+	Status   string           `json:"status"`
+	Attempts []WebhookAttempt `json:"attempts"`
+}
+
+// WebhookAttempt is a single try at delivering an event.
+type WebhookAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Duration   string    `json:"duration"`
+}
+
+// WebhookSender posts signed JSON payloads to webhooks, in the background, retrying failed deliveries with exponential
+// backoff. It keeps the latest deliveries to each webhook in memory, so they can be looked into. It is safe for
+// concurrent use.
+type WebhookSender struct {
+	// Client posts the payloads. Should have a timeout.
+	Client *http.Client
+
+	// MaxRetries is how many times a failed delivery is retried before giving up.
+	MaxRetries int
+
+	// MinBackoff is how long to wait before the first retry; each following one waits twice as long, up to
+	// MaxBackoff. A Retry-After header in the response takes precedence.
+	MinBackoff, MaxBackoff time.Duration
+
+	// LogSize is how many deliveries are kept per webhook.
+	LogSize int
+
+	// Log receives a line for every failed attempt, unless the context given to Send carries a logger of its own; see
+	// WithLogger. May be nil.
+	Log Logger
+
+	mu         sync.Mutex
+	deliveries map[string][]*WebhookDelivery // by webhook ID, oldest first
+}
+
+// NewWebhookSender creates an app.WebhookSender which posts with the given client, retrying failed deliveries at most
+// maxRetries times, from 30 seconds up to 30 minutes apart, and keeping the latest 20 deliveries to each webhook.
+func NewWebhookSender(client *http.Client, maxRetries int, logger Logger) *WebhookSender {
+	return &WebhookSender{
+		Client:     client,
+		MaxRetries: maxRetries,
+		MinBackoff: 30 * time.Second,
+		MaxBackoff: 30 * time.Minute,
+		LogSize:    20,
+		Log:        logger,
+	}
+}
+
+// Send posts the given payload to the webhook, in the background, until it's delivered, retries run out or ctx is
+// done. The request carries the event and the delivery ID in the X-Webhook-Event and X-Webhook-Delivery headers, and
+// the payload's signature in X-Webhook-Signature, as per SignWebhookPayload.
+func (s *WebhookSender) Send(ctx context.Context, id string, hook Webhook, event string, payload []byte) {
+	d := &WebhookDelivery{
+		ID:       id,
+		Webhook:  hook.ID,
+		URL:      hook.URL,
+		Event:    event,
+		Created:  time.Now(),
+		Status:   "pending",
+		Attempts: []WebhookAttempt{},
+	}
+
+	s.mu.Lock()
+	if s.deliveries == nil {
+		s.deliveries = map[string][]*WebhookDelivery{}
+	}
+
+	deliveries := append(s.deliveries[hook.ID], d)
+	if len(deliveries) > s.LogSize {
+		deliveries = deliveries[len(deliveries)-s.LogSize:]
+	}
+
+	s.deliveries[hook.ID] = deliveries
+	s.mu.Unlock()
+
+	go s.deliver(ctx, hook, d, payload)
+}
+
+// Deliveries returns the latest deliveries to the given webhooks, newest first.
+func (s *WebhookSender) Deliveries(webhookIDs ...string) []WebhookDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := []WebhookDelivery{}
+	for _, id := range webhookIDs {
+		for _, d := range s.deliveries[id] {
+			c := *d
+			c.Attempts = append([]WebhookAttempt{}, d.Attempts...)
+			result = append(result, c)
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Created.After(result[j].Created) })
+	return result
+}
+
+// Forget drops the log of the given webhook, e.g. because it was deleted. Deliveries still pending are given up on.
+func (s *WebhookSender) Forget(webhookID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.deliveries[webhookID] {
+		if d.Status == "pending" {
+			d.Status = "failed"
+		}
+	}
+
+	delete(s.deliveries, webhookID)
+}
+
+// deliver tries to post the payload until it works, or there's no point in trying again.
+func (s *WebhookSender) deliver(ctx context.Context, hook Webhook, d *WebhookDelivery, payload []byte) {
+	signature := SignWebhookPayload(hook.Secret, payload)
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err := s.post(ctx, hook.URL, d, signature, payload)
+
+		a := WebhookAttempt{Time: start, Duration: time.Since(start).String()}
+		if err != nil {
+			a.Error = err.Error()
+		} else {
+			a.StatusCode = resp.StatusCode
+		}
+
+		delivered := err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300
+		retry := !delivered && attempt < s.MaxRetries && isRetriableDelivery(ctx, resp, err)
+
+		s.mu.Lock()
+		if d.Status != "pending" { // XXX forgotten in the meantime
+			s.mu.Unlock()
+			return
+		}
+
+		d.Attempts = append(d.Attempts, a)
+		switch {
+		case delivered:
+			d.Status = "delivered"
+		case !retry:
+			d.Status = "failed"
+		}
+		s.mu.Unlock()
+
+		if !retry {
+			if !delivered {
+				s.logf(ctx, "Gave up delivering %s to webhook %s after %d attempts", d.ID, hook.ID, attempt+1)
+			}
+
+			return
+		}
+
+		wait := s.backoff(attempt, resp)
+		s.logf(ctx, "Delivering %s to webhook %s failed (%s); retry %d of %d in %v", d.ID, hook.ID, describe(resp, err),
+			attempt+1, s.MaxRetries, wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// post sends a single attempt. The response's body is already read and closed.
+func (s *WebhookSender) post(ctx context.Context, url string, d *WebhookDelivery, signature string, payload []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mea-libris")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", d.ID)
+	req.Header.Set("X-Webhook-Signature", signature)
+
+	resp, err := s.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	// XXX draining the body, so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	return resp, nil
+}
+
+// backoff returns how long to wait before the next attempt: whatever Retry-After says, if present, or MinBackoff *
+// 2^attempt, capped at MaxBackoff.
+func (s *WebhookSender) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if wait, ok := retryAfter(resp.Header.Get("Retry-After")); ok && wait <= s.MaxBackoff {
+			return wait
+		}
+	}
+
+	wait := s.MinBackoff << uint(attempt)
+	if wait <= 0 || wait > s.MaxBackoff {
+		wait = s.MaxBackoff
+	}
+
+	return wait
+}
+
+func (s *WebhookSender) logf(ctx context.Context, format string, v ...interface{}) {
+	if l := LoggerFrom(ctx, s.Log); l != nil {
+		l.Printf(format, v...)
+	}
+}
+
+// isRetriableDelivery returns true if a delivery failed in a way that might not happen again. Other client errors mean
+// the receiver doesn't want it, so there's no point in insisting.
+func isRetriableDelivery(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil // cancellations aren't transient
+	}
+
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusRequestTimeout
+}
+
+// SignWebhookPayload returns the signature of a webhook's payload: "sha256=" followed by the hex-encoded HMAC-SHA256
+// of the payload, keyed with the webhook's secret. Receivers should compute the same and compare them in constant
+// time.
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// privateNetworks are where webhooks may not point to, unless allowed: loopback, private, link-local (cloud metadata
+// services live there) and unspecified addresses.
+var privateNetworks, _ = ParseTrustedProxies("127.0.0.0/8, 10.0.0.0/8, 172.16.0.0/12, 192.168.0.0/16, " +
+	"100.64.0.0/10, 169.254.0.0/16, 0.0.0.0/8, ::1, ::/128, fc00::/7, fe80::/10")
+
+// NewWebhookClient creates an *http.Client for posting to webhooks, with the given timeout. Unless allowPrivate is
+// true, it refuses to connect to private addresses, so users can't have the server probe its own network. That's
+// checked as connections are made, after names are resolved, so redirects and DNS tricks are covered too.
+func NewWebhookClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			if privateNetworks.Trusts(address) {
+				return fmt.Errorf("Webhooks can't point to private addresses like %s", address)
+			}
+
+			return nil
+		}
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hanjos/mea-libris/app"
+	"github.com/hanjos/mea-libris/libris"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// calibreFileTypes are the formats preferred for a book's FileType, in order.
+var calibreFileTypes = []string{"EPUB", "PDF"}
+
+// calibreProvider lists the books in a Calibre library, read straight from its metadata.db. The library belongs to
+// the whole instance, not to a user, so there's nothing to connect to.
+type calibreProvider struct {
+	app.Router
+
+	path string
+	db   *sql.DB
+}
+
+// newCalibreProvider opens, read-only, the Calibre library in the given path, which may be either the library's
+// directory or its metadata.db.
+func newCalibreProvider(path string) (*calibreProvider, error) {
+	if info, err := os.Stat(path); err != nil {
+		return nil, errCantOpenCalibreLibrary(path, err)
+	} else if info.IsDir() {
+		path = filepath.Join(path, "metadata.db")
+	}
+
+	// XXX Calibre may be running, so we never write, and let SQLite deal with the locks
+	db, err := sql.Open("sqlite3", "file:"+(&url.URL{Path: path}).EscapedPath()+"?mode=ro")
+	if err != nil {
+		return nil, errCantOpenCalibreLibrary(path, err)
+	}
+
+	return &calibreProvider{
+		Router: app.NewRouter("/calibre"),
+		path:   path,
+		db:     db,
+	}, nil
+}
+
+// Name implements the app.Provider interface.
+func (cal *calibreProvider) Name() string {
+	return "calibre"
+}
+
+// CheckHealth implements the app.HealthChecker interface, checking that the library can be read.
+func (cal *calibreProvider) CheckHealth(ctx context.Context) error {
+	var n int
+	if err := cal.db.QueryRowContext(ctx, "SELECT count(*) FROM books").Scan(&n); err != nil {
+		return errCantOpenCalibreLibrary(cal.path, err)
+	}
+
+	return nil
+}
+
+// HandleBooks lists every book in the library.
+func (cal *calibreProvider) HandleBooks(w http.ResponseWriter, r *http.Request) *app.Error {
+	bs, err := cal.ListBooks(r)
+	if err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	err = encodeBooks(bs, w, r)
+	if err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+// ListBooks implements the app.Lister interface.
+func (cal *calibreProvider) ListBooks(r *http.Request) (libris.Books, error) {
+	bs, err := getCalibreBooks(r.Context(), cal.db)
+	if err != nil {
+		return nil, err
+	}
+
+	observeBooks(cal.Name(), bs)
+	return bs, nil
+}
+
+// HandleConnect has nothing to do, since the library is always available.
+func (cal *calibreProvider) HandleConnect(w http.ResponseWriter, r *http.Request) *app.Error {
+	fmt.Fprintln(w, "Connected! The Calibre library needs no authorization.")
+	return nil
+}
+
+// HandleDisconnect has nothing to do, since the library is always available.
+func (cal *calibreProvider) HandleDisconnect(w http.ResponseWriter, r *http.Request) *app.Error {
+	fmt.Fprintln(w, "The Calibre library needs no authorization. Nothing was done.")
+	return nil
+}
+
+// HandleOAuthCallback has nothing to do, since Calibre doesn't use OAuth.
+func (cal *calibreProvider) HandleOAuthCallback(w http.ResponseWriter, r *http.Request) *app.Error {
+	return app.Wrap(errNoOAuth(cal.Name()), http.StatusNotFound)
+}
+
+// STEP FUNCTIONS
+
+// getCalibreBooks reads every book in a Calibre library. The books themselves come in a single query, and each of
+// their multi-valued attributes (authors, tags, identifiers and formats) in another, to be matched by book ID.
+func getCalibreBooks(ctx context.Context, db *sql.DB) ([]*libris.Book, error) {
+	logFrom(ctx).Info("Getting the books in the Calibre library")
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT b.id, b.title, b.series_index, coalesce(p.name, ''), coalesce(s.name, ''), coalesce(r.rating, 0)
+		FROM books b
+		LEFT JOIN books_publishers_link bp ON bp.book = b.id
+		LEFT JOIN publishers p ON p.id = bp.publisher
+		LEFT JOIN books_series_link bs ON bs.book = b.id
+		LEFT JOIN series s ON s.id = bs.series
+		LEFT JOIN books_ratings_link br ON br.book = b.id
+		LEFT JOIN ratings r ON r.id = br.rating
+		ORDER BY b.sort`)
+	if err != nil {
+		return nil, errCantReadCalibreLibrary(err)
+	}
+	defer rows.Close()
+
+	myBooks := []*libris.Book{}
+	byID := map[int64]*libris.Book{}
+	for rows.Next() {
+		var id int64
+		var rating int
+		b := &libris.Book{}
+		if err := rows.Scan(&id, &b.Title, &b.SeriesIndex, &b.Publisher, &b.Series, &rating); err != nil {
+			return nil, errCantReadCalibreLibrary(err)
+		}
+
+		if b.Series == "" {
+			b.SeriesIndex = 0 // XXX Calibre defaults it to 1 even without a series
+		}
+
+		b.MyRating = float64(rating) / 2 // XXX Calibre counts half-stars
+		myBooks = append(myBooks, b)
+		byID[id] = b
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errCantReadCalibreLibrary(err)
+	}
+
+	err = eachCalibreValue(ctx, db, `
+		SELECT ba.book, a.name, '' FROM books_authors_link ba JOIN authors a ON a.id = ba.author ORDER BY ba.id`,
+		func(id int64, name, _ string) {
+			if b, ok := byID[id]; ok {
+				b.Authors = append(b.Authors, name)
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachCalibreValue(ctx, db, `
+		SELECT bt.book, t.name, '' FROM books_tags_link bt JOIN tags t ON t.id = bt.tag ORDER BY t.name`,
+		func(id int64, name, _ string) {
+			if b, ok := byID[id]; ok {
+				b.Tags = append(b.Tags, name)
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachCalibreValue(ctx, db, `SELECT book, type, val FROM identifiers`,
+		func(id int64, idType, value string) {
+			if b, ok := byID[id]; ok {
+				if b.Identifiers == nil {
+					b.Identifiers = map[string]string{}
+				}
+
+				b.Identifiers[idType] = value
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachCalibreValue(ctx, db, `SELECT book, format, '' FROM data ORDER BY format`,
+		func(id int64, format, _ string) {
+			if b, ok := byID[id]; ok {
+				b.Formats = append(b.Formats, strings.ToUpper(format))
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range myBooks {
+		b.Identifier, b.IdentifierType = calibreIdentifier(b.Identifiers)
+		b.FileType = calibreFileType(b.Formats)
+	}
+
+	logFrom(ctx).Infof("%d books processed", len(myBooks))
+	return myBooks, nil
+}
+
+// eachCalibreValue runs a query returning a book ID and two strings per row, and calls fn for each row.
+func eachCalibreValue(ctx context.Context, db *sql.DB, query string, fn func(id int64, a, b string)) error {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return errCantReadCalibreLibrary(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var a, b string
+		if err := rows.Scan(&id, &a, &b); err != nil {
+			return errCantReadCalibreLibrary(err)
+		}
+
+		fn(id, a, b)
+	}
+
+	if err := rows.Err(); err != nil {
+		return errCantReadCalibreLibrary(err)
+	}
+
+	return nil
+}
+
+// calibreIdentifier picks the main identifier for a book: its ISBN if there's one, or else any other, in a stable
+// order.
+func calibreIdentifier(identifiers map[string]string) (string, string) {
+	if isbn, ok := identifiers["isbn"]; ok {
+		switch len(isbn) {
+		case 13:
+			return isbn, "ISBN_13"
+		case 10:
+			return isbn, "ISBN_10"
+		default:
+			return isbn, "ISBN"
+		}
+	}
+
+	var first string
+	for idType := range identifiers {
+		if first == "" || idType < first {
+			first = idType
+		}
+	}
+
+	if first == "" {
+		return "", ""
+	}
+
+	return identifiers[first], strings.ToUpper(first)
+}
+
+// calibreFileType picks the preferred format for a book, using the same names newBook does for Google's.
+func calibreFileType(formats []string) string {
+	for _, fileType := range calibreFileTypes {
+		for _, format := range formats {
+			if format == fileType {
+				return fileType
+			}
+		}
+	}
+
+	if len(formats) > 0 {
+		return formats[0]
+	}
+
+	return "UNKNOWN"
+}
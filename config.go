@@ -0,0 +1,486 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hanjos/mea-libris/app"
+)
+
+// Config holds every setting mea-libris needs to run. Each setting has a command-line flag (e.g. -google-client-id)
+// and an environment variable (e.g. GOOGLE_CLIENT_ID), and may also come from a JSON config file, keyed by flag name.
+// Flags win over environment variables, which win over the config file, which wins over the defaults.
+type Config struct {
+	Port       string
+	SessionKey string
+
+	GoogleClientID     string
+	GoogleClientSecret string
+	GoogleRedirectURL  string
+	GooglePageWorkers  int
+	GoogleMaxRetries   int
+	GoogleQPS          int
+	GoogleCacheTTL     time.Duration
+	GoogleCallTimeout  time.Duration
+
+	TrustedProxies string
+
+	RequestTimeout  time.Duration
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	TLSCertFile     string
+	TLSKeyFile      string
+
+	OpenLibraryURL        string
+	OpenLibraryMaxRetries int
+	OpenLibraryTimeout    time.Duration
+	ImportDir             string
+	CalibreLibrary        string
+	BooksDir              string
+
+	SnapshotsKept    int
+	SnapshotDir      string
+	SnapshotInterval time.Duration
+
+	ExportTarget     string
+	ExportFormats    string
+	ExportInterval   time.Duration
+	ExportKeep       int
+	ExportKey        string
+	ExportSecret     string
+	ExportS3Endpoint string
+	ExportS3Region   string
+
+	WebhookInterval     time.Duration
+	WebhookMaxRetries   int
+	WebhookAllowPrivate bool
+
+	Metrics bool
+
+	LogFormat string
+	LogLevel  string
+
+	OTLPEndpoint string
+
+	AccountsFile     string
+	AllowSignup      bool
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+
+	// where each setting came from, by flag name
+	sources map[string]string
+	flags   *flag.FlagSet
+}
+
+// configFileFlag and configFileEnv name the flag and the environment variable holding the config file's path.
+const (
+	configFileFlag = "config"
+	configFileEnv  = "CONFIG_FILE"
+)
+
+// secretSettings are masked when the configuration is printed.
+var secretSettings = map[string]bool{
+	"session-key":          true,
+	"google-client-secret": true,
+	"oidc-client-secret":   true,
+	"export-secret":        true,
+}
+
+// bind registers a flag for every setting in c, with its default value.
+func (c *Config) bind(fs *flag.FlagSet) {
+	fs.StringVar(&c.Port, "port", "8080", "the port which this server will listen to")
+	fs.StringVar(&c.SessionKey, "session-key", "",
+		"a secret of at least 32 characters which session cookies are signed and encrypted with; random if empty")
+
+	fs.StringVar(&c.GoogleClientID, "google-client-id", "", "this app's Google OAuth client ID (required)")
+	fs.StringVar(&c.GoogleClientSecret, "google-client-secret", "", "this app's Google OAuth client secret (required)")
+	fs.StringVar(&c.GoogleRedirectURL, "google-redirect-url", "",
+		"the URL Google's OAuth server will respond to; detected from the request if empty")
+	fs.IntVar(&c.GooglePageWorkers, "google-page-workers", 4,
+		"how many pages of the user's books will be fetched from Google at the same time")
+	fs.IntVar(&c.GoogleMaxRetries, "google-max-retries", 3,
+		"how many times a call to Google failing with a transient error (429 or 5xx) will be retried")
+	fs.IntVar(&c.GoogleQPS, "google-qps", 10,
+		"the maximum number of calls per second to Google, counting retries; 0 means no limit")
+	fs.DurationVar(&c.GoogleCacheTTL, "google-cache-ttl", 5*time.Minute,
+		"how long a user's books are cached before being fetched again; 0 disables the cache")
+	fs.DurationVar(&c.GoogleCallTimeout, "google-call-timeout", 10*time.Second,
+		"how long a single call to Google may take, retries included")
+
+	fs.StringVar(&c.TrustedProxies, "trusted-proxies", "",
+		"comma-separated IPs and CIDR networks of reverse proxies whose forwarding headers are believed; * trusts all")
+
+	fs.DurationVar(&c.RequestTimeout, "request-timeout", 30*time.Second,
+		"how long a request to this server may take; 0 means no limit")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", 10*time.Second, "the server's timeout for reading a request")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", 60*time.Second, "the server's timeout for writing a response")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 120*time.Second, "how long the server keeps idle connections")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 30*time.Second,
+		"how long the server waits for in-flight requests after a SIGINT or SIGTERM")
+	fs.StringVar(&c.TLSCertFile, "tls-cert-file", "", "a certificate; if given with -tls-key-file, serves HTTPS")
+	fs.StringVar(&c.TLSKeyFile, "tls-key-file", "", "the certificate's private key")
+
+	fs.StringVar(&c.OpenLibraryURL, "openlibrary-url", "https://openlibrary.org",
+		"where Open Library's API lives; empty disables the Open Library provider")
+	fs.IntVar(&c.OpenLibraryMaxRetries, "openlibrary-max-retries", 3,
+		"how many times a call to Open Library which failed with a transient error (429 or 5xx) will be retried")
+	fs.DurationVar(&c.OpenLibraryTimeout, "openlibrary-timeout", 10*time.Second,
+		"how long a single call to Open Library (retries included) may take; 0 means no limit")
+	fs.StringVar(&c.ImportDir, "import-dir", "",
+		"where imported books are kept, one JSON file per user; if empty, they're kept in memory")
+	fs.StringVar(&c.CalibreLibrary, "calibre-library", "",
+		"a Calibre library's directory or metadata.db; empty disables the Calibre provider")
+	fs.StringVar(&c.BooksDir, "books-dir", "",
+		"a directory to scan for EPUB and PDF files; empty disables the folder provider")
+
+	fs.IntVar(&c.SnapshotsKept, "snapshots-kept", 20,
+		"how many snapshots of each account's Google books are kept for /google/changes; 0 disables it")
+	fs.StringVar(&c.SnapshotDir, "snapshot-dir", "",
+		"where snapshots are kept, one JSON file per user; if empty, they're kept in memory")
+	fs.DurationVar(&c.SnapshotInterval, "snapshot-interval", time.Hour,
+		"how often the Google books of accounts connected to Google are snapshotted; 0 means only when they're fetched")
+
+	fs.StringVar(&c.ExportTarget, "export-target", "",
+		"where to export each account's Google books: a directory, webdav://, webdavs:// or s3://; empty disables exports")
+	fs.StringVar(&c.ExportFormats, "export-formats", "csv,json", "comma-separated formats to export in: csv, json")
+	fs.DurationVar(&c.ExportInterval, "export-interval", 24*time.Hour, "how often books are exported")
+	fs.IntVar(&c.ExportKeep, "export-keep", 7, "how many exports of each format are kept per account")
+	fs.StringVar(&c.ExportKey, "export-key", "", "the WebDAV username, or the S3 access key ID")
+	fs.StringVar(&c.ExportSecret, "export-secret", "", "the WebDAV password, or the S3 secret key")
+	fs.StringVar(&c.ExportS3Endpoint, "export-s3-endpoint", "https://s3.amazonaws.com",
+		"where the S3 API lives, for S3-compatible servers (e.g. MinIO)")
+	fs.StringVar(&c.ExportS3Region, "export-s3-region", "us-east-1", "the S3 bucket's region")
+
+	fs.DurationVar(&c.WebhookInterval, "webhook-interval", time.Hour,
+		"how often the Google books of accounts with webhooks are checked for changes; 0 disables webhooks")
+	fs.IntVar(&c.WebhookMaxRetries, "webhook-max-retries", 5, "how many times a failed webhook delivery is retried")
+	fs.BoolVar(&c.WebhookAllowPrivate, "webhook-allow-private", false,
+		"whether webhooks may point to private addresses, e.g. localhost or the local network")
+
+	fs.BoolVar(&c.Metrics, "metrics", false,
+		"whether to expose Prometheus metrics in /metrics, to anyone who can reach this server")
+
+	fs.StringVar(&c.LogFormat, "log-format", "logfmt", "how log lines are written: logfmt or json")
+	fs.StringVar(&c.LogLevel, "log-level", "info", "the least severe level logged: debug, info, warn or error")
+
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", "",
+		"the base URL of an OTLP/HTTP collector to export traces to (e.g. http://localhost:4318); empty disables tracing")
+
+	fs.StringVar(&c.AccountsFile, "accounts-file", "",
+		"a JSON file where accounts and their connections are kept; if empty, they're kept in memory")
+	fs.BoolVar(&c.AllowSignup, "allow-signup", true, "whether anyone may create an account with a password")
+	fs.StringVar(&c.OIDCIssuer, "oidc-issuer", "", "an OpenID Connect issuer to log in through; empty disables it")
+	fs.StringVar(&c.OIDCClientID, "oidc-client-id", "", "this app's OIDC client ID")
+	fs.StringVar(&c.OIDCClientSecret, "oidc-client-secret", "", "this app's OIDC client secret")
+}
+
+// loadConfig builds a Config from the defaults, the config file (if any), the environment and the given command-line
+// arguments, in increasing order of precedence. Returns every problem found parsing the values, but doesn't validate
+// them; that's Validate's job.
+func loadConfig(args []string) (*Config, error) {
+	c := &Config{
+		sources: map[string]string{},
+		flags:   flag.NewFlagSet("mea-libris", flag.ContinueOnError),
+	}
+
+	c.bind(c.flags)
+	configFile := c.flags.String(configFileFlag, os.Getenv(configFileEnv),
+		"a JSON file with settings keyed by flag name, e.g. {\"port\": \"8080\"}")
+
+	if err := c.flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if c.flags.NArg() > 0 {
+		return nil, errUnexpectedArguments(c.flags.Args())
+	}
+
+	c.flags.VisitAll(func(f *flag.Flag) { c.sources[f.Name] = "default" })
+	c.flags.Visit(func(f *flag.Flag) { c.sources[f.Name] = "flag" })
+
+	var problems []string
+	set := func(name, value, source string) {
+		if c.sources[name] == "flag" {
+			return
+		}
+
+		if err := c.flags.Set(name, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (from %s): invalid value %q", name, source, value))
+			return
+		}
+
+		c.sources[name] = source
+	}
+
+	if *configFile != "" {
+		if c.sources[configFileFlag] != "flag" {
+			c.sources[configFileFlag] = "env"
+		}
+
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if name == configFileFlag || c.flags.Lookup(name) == nil {
+				problems = append(problems, fmt.Sprintf("%s (from file): unknown setting", name))
+				continue
+			}
+
+			set(name, values[name], "file")
+		}
+	}
+
+	c.flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == configFileFlag {
+			return
+		}
+
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			set(f.Name, value, "env")
+		}
+	})
+
+	if len(problems) > 0 {
+		return nil, errInvalidConfig(problems)
+	}
+
+	return c, nil
+}
+
+// readConfigFile reads a JSON object, keyed by flag name, from the given file. Values may be strings, numbers or
+// booleans.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errCantReadConfigFile(path, err)
+	}
+
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, errCantReadConfigFile(path, err)
+	}
+
+	values := map[string]string{}
+	for name, v := range raw {
+		values[name] = fmt.Sprint(v)
+	}
+
+	return values, nil
+}
+
+// Validate checks that the settings make sense together, returning every problem found in a single error.
+func (c *Config) Validate() error {
+	var problems []string
+	report := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, v...))
+	}
+
+	if n, err := strconv.Atoi(c.Port); err != nil || n < 1 || n > 65535 {
+		report("port: %q isn't a valid port number", c.Port)
+	}
+
+	if c.SessionKey != "" && len(c.SessionKey) < minSessionKeyLength {
+		report("session-key: must have at least %d characters, not %d", minSessionKeyLength, len(c.SessionKey))
+	}
+
+	for _, name := range []string{"google-client-id", "google-client-secret"} {
+		if c.flags.Lookup(name).Value.String() == "" {
+			report("%s: missing; this app's Google credentials are needed to reach the user's books. Set the -%s "+
+				"flag, the %s environment variable or %q in the config file", name, name, envName(name), name)
+		}
+	}
+
+	if c.GoogleRedirectURL != "" {
+		if u, err := url.Parse(c.GoogleRedirectURL); err != nil || !u.IsAbs() || u.Host == "" {
+			report("google-redirect-url: %q isn't an absolute URL", c.GoogleRedirectURL)
+		}
+	}
+
+	if _, err := app.ParseTrustedProxies(c.TrustedProxies); err != nil {
+		report("trusted-proxies: %v", err)
+	}
+
+	if c.OpenLibraryURL != "" {
+		if u, err := url.Parse(c.OpenLibraryURL); err != nil || !u.IsAbs() || u.Host == "" {
+			report("openlibrary-url: %q isn't an absolute URL", c.OpenLibraryURL)
+		}
+	}
+
+	if c.OIDCIssuer != "" {
+		if u, err := url.Parse(c.OIDCIssuer); err != nil || !u.IsAbs() || u.Host == "" {
+			report("oidc-issuer: %q isn't an absolute URL", c.OIDCIssuer)
+		}
+
+		for _, name := range []string{"oidc-client-id", "oidc-client-secret"} {
+			if c.flags.Lookup(name).Value.String() == "" {
+				report("%s: missing; needed to log in through the OIDC issuer", name)
+			}
+		}
+	}
+
+	if c.GooglePageWorkers < 1 {
+		report("google-page-workers: must be at least 1, not %d", c.GooglePageWorkers)
+	}
+
+	if c.GoogleMaxRetries < 0 {
+		report("google-max-retries: can't be negative (%d)", c.GoogleMaxRetries)
+	}
+
+	if c.OpenLibraryMaxRetries < 0 {
+		report("openlibrary-max-retries: can't be negative (%d)", c.OpenLibraryMaxRetries)
+	}
+
+	if c.SnapshotsKept < 0 {
+		report("snapshots-kept: can't be negative (%d)", c.SnapshotsKept)
+	}
+
+	if c.SnapshotInterval > 0 && c.SnapshotInterval < time.Minute {
+		report("snapshot-interval: must be at least 1m, or 0 to take snapshots only on fetches, not %v", c.SnapshotInterval)
+	}
+
+	if c.ExportTarget != "" {
+		if _, err := newExportTarget(c); err != nil {
+			report("export-target: %v", err)
+		}
+
+		if formats, err := splitValues("export-formats", []string{c.ExportFormats}, exportFormatNames); err != nil {
+			report("export-formats: %v", err)
+		} else if len(formats) == 0 {
+			report("export-formats: missing; at least one of %s is needed", strings.Join(exportFormatNames, ", "))
+		}
+
+		if c.ExportInterval < time.Minute {
+			report("export-interval: must be at least 1m, not %v", c.ExportInterval)
+		}
+
+		if c.ExportKeep < 1 {
+			report("export-keep: must be at least 1, not %d", c.ExportKeep)
+		}
+	}
+
+	if c.WebhookInterval > 0 && c.WebhookInterval < time.Minute {
+		report("webhook-interval: must be at least 1m, or 0 to disable webhooks, not %v", c.WebhookInterval)
+	}
+
+	if c.WebhookMaxRetries < 0 {
+		report("webhook-max-retries: can't be negative (%d)", c.WebhookMaxRetries)
+	}
+
+	if _, ok := logFormats[c.LogFormat]; !ok {
+		report("log-format: %q isn't one of %s", c.LogFormat, strings.Join(logFormatNames, ", "))
+	}
+
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		report("log-level: %q isn't one of %s", c.LogLevel, strings.Join(logLevelNames, ", "))
+	}
+
+	if c.OTLPEndpoint != "" {
+		if _, err := otlpTracesURL(c.OTLPEndpoint); err != nil {
+			report("otlp-endpoint: %v", err)
+		}
+	}
+
+	if c.GoogleQPS < 0 {
+		report("google-qps: can't be negative (%d)", c.GoogleQPS)
+	}
+
+	c.flags.VisitAll(func(f *flag.Flag) {
+		if d, ok := f.Value.(flag.Getter).Get().(time.Duration); ok && d < 0 {
+			report("%s: can't be negative (%v)", f.Name, d)
+		}
+	})
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		report("tls-cert-file and tls-key-file: both are needed to serve HTTPS")
+	}
+
+	for _, file := range []string{c.TLSCertFile, c.TLSKeyFile, c.CalibreLibrary, c.BooksDir} {
+		if file == "" {
+			continue
+		}
+
+		if _, err := os.Stat(file); err != nil {
+			report("%v", err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errInvalidConfig(problems)
+	}
+
+	return nil
+}
+
+// Print writes every setting, with its environment variable, its value and where it came from. Secrets are masked.
+func (c *Config) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tENVIRONMENT\tVALUE\tSOURCE")
+
+	c.flags.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretSettings[f.Name] && value != "" {
+			value = "********"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", f.Name, envName(f.Name), defaultTo(value, `""`), c.sources[f.Name])
+	})
+
+	return tw.Flush()
+}
+
+// configCommand runs the `config` subcommand. Right now, there's only `config check`, which prints the effective
+// configuration and validates it. Returns the process' exit code.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "Usage: mea-libris config check [flags]")
+		return 2
+	}
+
+	c, err := loadConfig(args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	c.Print(os.Stdout)
+
+	if err := c.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Println()
+	fmt.Println("Configuration OK.")
+	return 0
+}
+
+// envName returns the environment variable for the given flag, e.g. GOOGLE_CLIENT_ID for google-client-id.
+func envName(flagName string) string {
+	if flagName == configFileFlag {
+		return configFileEnv
+	}
+
+	return strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
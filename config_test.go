@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// unsetenv removes the given environment variable for the rest of the test.
+func unsetenv(t *testing.T, name string) {
+	t.Setenv(name, "")
+	os.Unsetenv(name)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		flag   string
+		env    string
+		file   string
+		want   string
+		source string
+	}{
+		{"default", "", "", "", "8080", "default"},
+		{"file", "", "", "7000", "7000", "file"},
+		{"env over file", "", "7001", "7000", "7001", "env"},
+		{"flag over env and file", "7002", "7001", "7000", "7002", "flag"},
+		{"flag over file", "7002", "", "7000", "7002", "flag"},
+		{"flag over env", "7002", "7001", "", "7002", "flag"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			unsetenv(t, "PORT")
+			unsetenv(t, configFileEnv)
+
+			var args []string
+			if test.flag != "" {
+				args = append(args, "-port", test.flag)
+			}
+
+			if test.env != "" {
+				t.Setenv("PORT", test.env)
+			}
+
+			if test.file != "" {
+				path := filepath.Join(t.TempDir(), "config.json")
+				if err := os.WriteFile(path, []byte(`{"port": "`+test.file+`"}`), 0600); err != nil {
+					t.Fatal(err)
+				}
+
+				t.Setenv(configFileEnv, path)
+			}
+
+			c, err := loadConfig(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.Port != test.want {
+				t.Errorf("got port %s, want %s", c.Port, test.want)
+			}
+
+			if got := c.sources["port"]; got != test.source {
+				t.Errorf("got the port from %s, want from %s", got, test.source)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	unsetenv(t, configFileEnv)
+	unsetenv(t, "GOOGLE_PAGE_WORKERS")
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		return path
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{"unknown flag", []string{"-no-such-setting", "1"}, nil, "no-such-setting"},
+		{"extra arguments", []string{"serve"}, nil, "serve"},
+		{"invalid env", nil, map[string]string{"GOOGLE_PAGE_WORKERS": "many"}, "google-page-workers (from env)"},
+		{"invalid in file", []string{"-config", write("invalid.json", `{"google-page-workers": "many"}`)}, nil,
+			"google-page-workers (from file)"},
+		{"unknown in file", []string{"-config", write("unknown.json", `{"no-such-setting": "1"}`)}, nil,
+			"no-such-setting (from file)"},
+		{"missing file", []string{"-config", filepath.Join(dir, "missing.json")}, nil, "missing.json"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			_, err := loadConfig(test.args)
+			if err == nil {
+				t.Fatal("got no error")
+			}
+
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got the error %q, want it to mention %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestConfigPrintMasksSecrets(t *testing.T) {
+	unsetenv(t, configFileEnv)
+
+	c, err := loadConfig([]string{"-google-client-secret", "hunter2", "-google-client-id", "the-client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := c.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out.String(), "hunter2") {
+		t.Errorf("the secret was printed:\n%s", out.String())
+	}
+
+	if !strings.Contains(out.String(), "the-client") {
+		t.Errorf("the client ID wasn't printed:\n%s", out.String())
+	}
+}
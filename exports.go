@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanjos/mea-libris/app"
+	"github.com/hanjos/mea-libris/libris"
+)
+
+// exportFormats are the formats books can be exported in, by name, which is also the files' extension.
+var exportFormats = map[string]func(bs libris.Books, w io.Writer) error{
+	"csv":  libris.Books.EncodeCSV,
+	"json": libris.Books.EncodeJSON,
+}
+
+// exportFormatNames are the keys of exportFormats, sorted.
+var exportFormatNames = []string{"csv", "json"}
+
+// exportFilePattern matches the names of export files, so nothing else is pruned.
+var exportFilePattern = regexp.MustCompile(`^\d{8}T\d{6}Z\.([a-z]+)$`)
+
+// newExportTarget creates the app.ExportTarget the given configuration points to.
+func newExportTarget(cfg *Config) (app.ExportTarget, error) {
+	client := &http.Client{Timeout: cfg.GoogleCallTimeout}
+	return app.NewExportTarget(cfg.ExportTarget, cfg.ExportKey, cfg.ExportSecret, cfg.ExportS3Endpoint,
+		cfg.ExportS3Region, client)
+}
+
+// exporter periodically exports the Google books of every account connected to Google, as files named
+// <username>/<time>.<format> in the target. Only the latest exports of each format are kept.
+type exporter struct {
+	goog     *googleProvider
+	target   app.ExportTarget
+	formats  []string
+	keep     int
+	interval time.Duration
+	timeout  time.Duration
+
+	mu       sync.Mutex
+	lastRun  time.Time
+	nextRun  time.Time
+	statuses map[string]*exportStatus // by account ID
+}
+
+// exportStatus is how an account's latest export went.
+type exportStatus struct {
+	Time   time.Time `json:"time"`
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	Books  int       `json:"books"`
+	Files  []string  `json:"files"`
+}
+
+func newExporter(goog *googleProvider, target app.ExportTarget, formats []string, keep int, interval, timeout time.Duration) *exporter {
+	return &exporter{
+		goog:     goog,
+		target:   target,
+		formats:  formats,
+		keep:     keep,
+		interval: interval,
+		timeout:  timeout,
+		statuses: map[string]*exportStatus{},
+	}
+}
+
+// Run exports right away, and then every interval, until ctx is done. Everything it logs is tagged with job=export.
+func (e *exporter) Run(ctx context.Context) {
+	ctx = app.WithLogger(ctx, logFrom(ctx).WithField("job", "export"))
+
+	e.mu.Lock()
+	e.nextRun = time.Now()
+	e.mu.Unlock()
+
+	for {
+		e.exportAll(ctx)
+
+		e.mu.Lock()
+		e.lastRun, e.nextRun = time.Now(), time.Now().Add(e.interval)
+		e.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.interval):
+		}
+	}
+}
+
+// exportAll exports the books of every account connected to Google, one at a time.
+func (e *exporter) exportAll(ctx context.Context) {
+	all, err := accounts.List()
+	if err != nil {
+		logFrom(ctx).Error(errCantExport("every account", errCantLoadAccount(err)))
+		return
+	}
+
+	logFrom(ctx).Infof("Exporting books to %s", e.target)
+	for _, a := range all {
+		if ctx.Err() != nil {
+			return
+		} else if a.Connections[e.goog.Name()] == "" {
+			continue
+		}
+
+		status := e.export(ctx, a)
+
+		e.mu.Lock()
+		e.statuses[a.ID] = status
+		e.mu.Unlock()
+	}
+}
+
+// export writes the given account's Google books to the target in every format, and prunes older exports.
+func (e *exporter) export(ctx context.Context, a *app.Account) *exportStatus {
+	status := &exportStatus{Time: time.Now().UTC(), Status: "ok", Files: []string{}}
+	fail := func(err error) *exportStatus {
+		err = errCantExport(a.Username, err)
+		logFrom(ctx).Error(err)
+
+		status.Status, status.Error = "error", err.Error()
+		return status
+	}
+
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+
+	bs, err := e.goog.accountBooks(ctx, a)
+	if err != nil {
+		return fail(err)
+	}
+
+	status.Books = len(bs)
+	stamp := status.Time.Format("20060102T150405Z")
+	for _, format := range e.formats {
+		var buf bytes.Buffer
+		if err := exportFormats[format](bs, &buf); err != nil {
+			return fail(errCantEncodeBooks(err))
+		}
+
+		name := exportDir(a.Username) + "/" + stamp + "." + format
+		if err := e.target.Put(ctx, name, buf.Bytes()); err != nil {
+			return fail(err)
+		}
+
+		status.Files = append(status.Files, name)
+	}
+
+	logFrom(ctx).Infof("Exported %d books for %s", len(bs), a.Username)
+	if err := e.prune(ctx, exportDir(a.Username)); err != nil {
+		return fail(err)
+	}
+
+	return status
+}
+
+// prune deletes all but the latest exports of each format in the given directory.
+func (e *exporter) prune(ctx context.Context, dir string) error {
+	names, err := e.target.List(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	byFormat := map[string][]string{}
+	for _, name := range names {
+		if m := exportFilePattern.FindStringSubmatch(name); m != nil {
+			byFormat[m[1]] = append(byFormat[m[1]], name)
+		}
+	}
+
+	for _, names := range byFormat {
+		sort.Strings(names) // XXX the names start with the time, so they sort chronologically
+		for i := 0; i < len(names)-e.keep; i++ {
+			if err := e.target.Delete(ctx, dir+"/"+names[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// exportDir returns the directory of the given user's exports, which is named after them. Usernames can't hold slashes,
+// but may be . or .., which are escaped so they don't point elsewhere; % isn't allowed in usernames, so nothing clashes.
+func exportDir(username string) string {
+	if username == "." || username == ".." {
+		return strings.Replace(username, ".", "%2E", -1)
+	}
+
+	return username
+}
+
+// showExports tells how the scheduled exports are set up and how the current account's latest export went, and
+// lists its exports in the target. Answers 404 if exports are disabled.
+func showExports(e *exporter) app.Handler {
+	return app.Handler(func(w http.ResponseWriter, r *http.Request) *app.Error {
+		if e == nil {
+			return app.Wrap(errExportsDisabled, http.StatusNotFound)
+		}
+
+		a, ok := currentAccount(r)
+		if !ok {
+			return app.Wrap(errNotLoggedIn, http.StatusUnauthorized)
+		}
+
+		exports, err := e.target.List(r.Context(), exportDir(a.Username))
+		if err != nil {
+			return app.Wrap(errCantExport(a.Username, err), http.StatusBadGateway)
+		}
+
+		e.mu.Lock()
+		lastRun, nextRun, last := e.lastRun, e.nextRun, e.statuses[a.ID]
+		e.mu.Unlock()
+
+		var lastRunJSON *time.Time
+		if !lastRun.IsZero() {
+			lastRunJSON = &lastRun
+		}
+
+		return writeJSON(w, http.StatusOK, struct {
+			Target    string        `json:"target"`
+			Formats   []string      `json:"formats"`
+			Keep      int           `json:"keep"`
+			Interval  string        `json:"interval"`
+			Connected bool          `json:"connected"`
+			LastRun   *time.Time    `json:"lastRun"`
+			NextRun   time.Time     `json:"nextRun"`
+			Last      *exportStatus `json:"last"`
+			Exports   []string      `json:"exports"`
+		}{
+			e.target.String(),
+			e.formats,
+			e.keep,
+			e.interval.String(),
+			a.Connections[e.goog.Name()] != "",
+			lastRunJSON,
+			nextRun,
+			last,
+			defaultToSlice(exports, []string{}),
+		})
+	})
+}
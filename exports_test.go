@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hanjos/mea-libris/app"
+)
+
+func TestExporterPrune(t *testing.T) {
+	tests := []struct {
+		name string
+		keep int
+		want []string
+	}{
+		{
+			"latest two of each format",
+			2,
+			[]string{"20240103T000000Z.json", "20240104T000000Z.csv", "20240104T000000Z.json", "20240105T000000Z.csv",
+				"notes.txt"},
+		},
+		{
+			"more than there are",
+			5,
+			[]string{"20240101T000000Z.csv", "20240102T000000Z.json", "20240103T000000Z.json", "20240104T000000Z.csv",
+				"20240104T000000Z.json", "20240105T000000Z.csv", "notes.txt"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := app.NewDirExportTarget(t.TempDir())
+			// XXX put out of order, so pruning can't count on it
+			for _, name := range []string{
+				"me/20240104T000000Z.csv", "me/20240101T000000Z.csv", "me/20240105T000000Z.csv",
+				"me/20240103T000000Z.json", "me/20240102T000000Z.json", "me/20240104T000000Z.json",
+				"me/notes.txt", "you/20240101T000000Z.csv",
+			} {
+				if err := target.Put(t.Context(), name, []byte("Title\n")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			e := newExporter(nil, target, exportFormatNames, test.keep, 0, 0)
+			if err := e.prune(t.Context(), "me"); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ := target.List(t.Context(), "me"); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("\n got %q\nwant %q", got, test.want)
+			}
+
+			if got, _ := target.List(t.Context(), "you"); len(got) != 1 {
+				t.Errorf("another user's exports were pruned: got %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanjos/mea-libris/app"
+	"github.com/hanjos/mea-libris/libris"
+	"github.com/ledongthuc/pdf"
+)
+
+// folderProvider lists the EPUB and PDF files in a directory, with whatever metadata they carry. The directory
+// belongs to the whole instance, not to a user, so there's nothing to connect to. Each file's metadata is kept until
+// the file changes, so only new or modified files are read on each request.
+type folderProvider struct {
+	app.Router
+
+	dir string
+
+	mu    sync.Mutex
+	files map[string]*folderFile
+}
+
+// folderFile is the metadata read from a file, and what the file looked like at the time.
+type folderFile struct {
+	modTime time.Time
+	size    int64
+	book    *libris.Book
+}
+
+func newFolderProvider(dir string) *folderProvider {
+	return &folderProvider{
+		Router: app.NewRouter("/folder"),
+		dir:    dir,
+		files:  map[string]*folderFile{},
+	}
+}
+
+// Name implements the app.Provider interface.
+func (fp *folderProvider) Name() string {
+	return "folder"
+}
+
+// CheckHealth implements the app.HealthChecker interface, checking that the directory is there.
+func (fp *folderProvider) CheckHealth(ctx context.Context) error {
+	if _, err := os.Stat(fp.dir); err != nil {
+		return errCantScanFolder(err)
+	}
+
+	return nil
+}
+
+// HandleBooks lists every EPUB and PDF file in the directory and below.
+func (fp *folderProvider) HandleBooks(w http.ResponseWriter, r *http.Request) *app.Error {
+	bs, err := fp.ListBooks(r)
+	if err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	err = encodeBooks(bs, w, r)
+	if err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+// ListBooks implements the app.Lister interface.
+func (fp *folderProvider) ListBooks(r *http.Request) (libris.Books, error) {
+	bs, err := fp.scan(r.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	observeBooks(fp.Name(), bs)
+	return bs, nil
+}
+
+// HandleConnect has nothing to do, since the directory is always available.
+func (fp *folderProvider) HandleConnect(w http.ResponseWriter, r *http.Request) *app.Error {
+	fmt.Fprintln(w, "Connected! The book folder needs no authorization.")
+	return nil
+}
+
+// HandleDisconnect has nothing to do, since the directory is always available.
+func (fp *folderProvider) HandleDisconnect(w http.ResponseWriter, r *http.Request) *app.Error {
+	fmt.Fprintln(w, "The book folder needs no authorization. Nothing was done.")
+	return nil
+}
+
+// HandleOAuthCallback has nothing to do, since a folder doesn't use OAuth.
+func (fp *folderProvider) HandleOAuthCallback(w http.ResponseWriter, r *http.Request) *app.Error {
+	return app.Wrap(errNoOAuth(fp.Name()), http.StatusNotFound)
+}
+
+// scan walks the directory, reading the metadata of new or modified files and forgetting the ones which are gone.
+func (fp *folderProvider) scan(ctx context.Context) ([]*libris.Book, error) {
+	logFrom(ctx).Infof("Scanning %s for books", fp.dir)
+
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	myBooks := []*libris.Book{}
+	seen := map[string]bool{}
+	err := filepath.Walk(fp.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			logFrom(ctx).Warnf("Skipping %s: %v", p, err)
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		fileType := folderFileType(p)
+		if info.IsDir() || fileType == "" {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(fp.dir, p)
+		seen[rel] = true
+
+		f, ok := fp.files[rel]
+		if !ok || !f.modTime.Equal(info.ModTime()) || f.size != info.Size() {
+			f = &folderFile{info.ModTime(), info.Size(), readFolderBook(ctx, p, rel, fileType)}
+			fp.files[rel] = f
+		}
+
+		myBooks = append(myBooks, f.book)
+		return nil
+	})
+	if err != nil {
+		return nil, errCantScanFolder(err)
+	}
+
+	for rel := range fp.files {
+		if !seen[rel] {
+			delete(fp.files, rel)
+		}
+	}
+
+	logFrom(ctx).Infof("%d books processed", len(myBooks))
+	return myBooks, nil
+}
+
+// STEP FUNCTIONS
+
+// folderFileType returns EPUB or PDF, the same file types newBook uses, depending on the file's extension. Returns ""
+// for anything else.
+func folderFileType(p string) string {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".epub":
+		return "EPUB"
+	case ".pdf":
+		return "PDF"
+	default:
+		return ""
+	}
+}
+
+// readFolderBook reads the metadata in a file. Should that fail, the book is still listed, titled after the file.
+func readFolderBook(ctx context.Context, p, rel, fileType string) *libris.Book {
+	var b *libris.Book
+	var err error
+	switch fileType {
+	case "EPUB":
+		b, err = readEPUBBook(p)
+	case "PDF":
+		b, err = readPDFBook(p)
+	}
+
+	if err != nil {
+		logFrom(ctx).Warnf("Couldn't read the metadata in %s: %v", p, err)
+	}
+
+	if b == nil {
+		b = &libris.Book{}
+	}
+
+	if b.Title == "" {
+		b.Title = filepath.Base(p)
+	}
+
+	b.Title = trimExtension(b.Title, fileType)
+	b.FileType = fileType
+	b.Formats = []string{fileType}
+	if b.Identifier == "" {
+		b.Identifier, b.IdentifierType = filepath.ToSlash(rel), "FILE"
+	}
+
+	return b
+}
+
+// epubContainer is an EPUB's META-INF/container.xml, which points to the OPF package.
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+// epubPackage is the metadata in an EPUB's OPF package. Both EPUB 2 and 3 are covered, as well as Calibre's
+// extensions for series.
+type epubPackage struct {
+	Metadata struct {
+		Titles   []string `xml:"title"`
+		Creators []struct {
+			Name string `xml:",chardata"`
+			Role string `xml:"role,attr"`
+		} `xml:"creator"`
+		Identifiers []struct {
+			Value  string `xml:",chardata"`
+			Scheme string `xml:"scheme,attr"`
+		} `xml:"identifier"`
+		Publisher string   `xml:"publisher"`
+		Subjects  []string `xml:"subject"`
+		Metas     []struct {
+			Name     string `xml:"name,attr"`
+			Content  string `xml:"content,attr"`
+			Property string `xml:"property,attr"`
+			ID       string `xml:"id,attr"`
+			Refines  string `xml:"refines,attr"`
+			Value    string `xml:",chardata"`
+		} `xml:"meta"`
+	} `xml:"metadata"`
+}
+
+// readEPUBBook reads the metadata in an EPUB's OPF package.
+func readEPUBBook(p string) (*libris.Book, error) {
+	z, err := zip.OpenReader(p)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+
+	container := &epubContainer{}
+	if err := decodeZippedXML(&z.Reader, "META-INF/container.xml", container); err != nil {
+		return nil, err
+	} else if len(container.Rootfiles) == 0 {
+		return nil, errNoOPFPackage
+	}
+
+	pkg := &epubPackage{}
+	if err := decodeZippedXML(&z.Reader, container.Rootfiles[0].FullPath, pkg); err != nil {
+		return nil, err
+	}
+
+	meta := pkg.Metadata
+	b := &libris.Book{
+		Publisher: strings.TrimSpace(meta.Publisher),
+	}
+
+	if len(meta.Titles) > 0 {
+		b.Title = strings.TrimSpace(meta.Titles[0])
+	}
+
+	for _, creator := range meta.Creators {
+		if creator.Role == "" || creator.Role == "aut" {
+			b.Authors = append(b.Authors, strings.TrimSpace(creator.Name))
+		}
+	}
+
+	for _, subject := range meta.Subjects {
+		b.Tags = append(b.Tags, strings.TrimSpace(subject))
+	}
+
+	for _, identifier := range meta.Identifiers {
+		idType, value := epubIdentifier(identifier.Scheme, strings.TrimSpace(identifier.Value))
+		if value == "" {
+			continue
+		}
+
+		if b.Identifiers == nil {
+			b.Identifiers = map[string]string{}
+		}
+
+		b.Identifiers[idType] = value
+	}
+
+	b.Identifier, b.IdentifierType = calibreIdentifier(b.Identifiers)
+
+	// series: Calibre's <meta name="calibre:series">, or EPUB 3's belongs-to-collection
+	collections := map[string]string{}
+	for _, m := range meta.Metas {
+		switch {
+		case m.Name == "calibre:series":
+			b.Series = m.Content
+		case m.Name == "calibre:series_index":
+			fmt.Sscan(m.Content, &b.SeriesIndex)
+		case m.Property == "belongs-to-collection" && b.Series == "":
+			b.Series = strings.TrimSpace(m.Value)
+			collections["#"+m.ID] = b.Series
+		case m.Property == "group-position" && b.Series != "" && collections[m.Refines] == b.Series:
+			fmt.Sscan(strings.TrimSpace(m.Value), &b.SeriesIndex)
+		}
+	}
+
+	return b, nil
+}
+
+// epubIdentifier returns the type and value of an EPUB identifier, from its scheme or its URN prefix.
+func epubIdentifier(scheme, value string) (string, string) {
+	lower := strings.ToLower(value)
+	switch {
+	case strings.HasPrefix(lower, "urn:isbn:"):
+		return "isbn", strings.Replace(value[len("urn:isbn:"):], "-", "", -1)
+	case strings.HasPrefix(lower, "isbn:"):
+		return "isbn", strings.Replace(value[len("isbn:"):], "-", "", -1)
+	case strings.EqualFold(scheme, "isbn"):
+		return "isbn", strings.Replace(value, "-", "", -1)
+	case strings.HasPrefix(lower, "urn:uuid:"):
+		return "uuid", value[len("urn:uuid:"):]
+	case scheme != "":
+		return strings.ToLower(scheme), value
+	default:
+		return "id", value
+	}
+}
+
+// decodeZippedXML decodes the XML file with the given name in a zip archive.
+func decodeZippedXML(z *zip.Reader, name string, v interface{}) error {
+	name = path.Clean(name)
+	for _, f := range z.File {
+		if path.Clean(f.Name) != name {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		return xml.NewDecoder(rc).Decode(v)
+	}
+
+	return errFileNotInArchive(name)
+}
+
+// readPDFBook reads the metadata in a PDF's info dictionary.
+func readPDFBook(p string) (b *libris.Book, err error) {
+	// XXX the PDF reader panics on some malformed files
+	defer func() {
+		if r := recover(); r != nil {
+			b, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+
+	f, r, err := pdf.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info := r.Trailer().Key("Info")
+	b = &libris.Book{
+		Title:   strings.TrimSpace(info.Key("Title").Text()),
+		Authors: splitPDFList(info.Key("Author").Text()),
+		Tags:    splitPDFList(info.Key("Keywords").Text()),
+	}
+
+	return b, nil
+}
+
+// splitPDFList splits a PDF info entry holding several values, separated by semicolons or commas.
+func splitPDFList(s string) []string {
+	separator := ","
+	if strings.Contains(s, ";") {
+		separator = ";"
+	}
+
+	var items []string
+	for _, item := range strings.Split(s, separator) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
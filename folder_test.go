@@ -0,0 +1,289 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hanjos/mea-libris/libris"
+)
+
+// writeEPUB writes an EPUB whose OPF package, at opfPath, holds the given metadata.
+func writeEPUB(t *testing.T, p, opfPath, metadata string) {
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+
+	files := []struct{ name, content string }{
+		{"mimetype", "application/epub+zip"},
+		{"META-INF/container.xml", `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="` + opfPath + `" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`},
+		{opfPath, `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">` + metadata + `
+  </metadata>
+</package>`},
+	}
+
+	for _, f := range files {
+		w, err := z.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.content))
+	}
+
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, p, buf.Bytes())
+}
+
+// writePDF writes an empty PDF whose info dictionary holds the given entries, already in PDF syntax.
+func writePDF(t *testing.T, p, info string) {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [] /Count 0 >>",
+		"<< " + info + " >>",
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+
+	var offsets []int
+	for i, object := range objects {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R /Info 3 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	writeFile(t, p, buf.Bytes())
+}
+
+func writeFile(t *testing.T, p string, content []byte) {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(p, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadEPUBBook(t *testing.T) {
+	tests := []struct {
+		name     string
+		opfPath  string
+		metadata string
+		want     *libris.Book
+	}{
+		{
+			"EPUB 2, with Calibre's series",
+			"OEBPS/content.opf",
+			`<dc:title>Dune</dc:title>
+			<dc:creator opf:role="aut">Frank Herbert</dc:creator>
+			<dc:creator opf:role="ill">John Schoenherr</dc:creator>
+			<dc:identifier opf:scheme="ISBN">978-0-441-17271-9</dc:identifier>
+			<dc:identifier opf:scheme="calibre">1234</dc:identifier>
+			<dc:publisher> Ace </dc:publisher>
+			<dc:subject>sf</dc:subject>
+			<dc:subject>classic</dc:subject>
+			<meta name="calibre:series" content="Dune"/>
+			<meta name="calibre:series_index" content="1.0"/>`,
+			&libris.Book{
+				Title: "Dune", Authors: []string{"Frank Herbert"}, Publisher: "Ace", Tags: []string{"sf", "classic"},
+				Identifier: "9780441172719", IdentifierType: "ISBN_13",
+				Identifiers: map[string]string{"isbn": "9780441172719", "calibre": "1234"},
+				Series:      "Dune", SeriesIndex: 1,
+			},
+		},
+		{
+			"EPUB 3, with a collection",
+			"content.opf",
+			`<dc:title>The Two Towers</dc:title>
+			<dc:title>Being the Second Part of The Lord of the Rings</dc:title>
+			<dc:creator>J. R. R. Tolkien</dc:creator>
+			<dc:identifier id="id">urn:isbn:0-261-10236-4</dc:identifier>
+			<meta property="belongs-to-collection" id="c1">The Lord of the Rings</meta>
+			<meta refines="#c1" property="collection-type">series</meta>
+			<meta refines="#c1" property="group-position">2</meta>`,
+			&libris.Book{
+				Title: "The Two Towers", Authors: []string{"J. R. R. Tolkien"},
+				Identifier: "0261102364", IdentifierType: "ISBN_10",
+				Identifiers: map[string]string{"isbn": "0261102364"},
+				Series:      "The Lord of the Rings", SeriesIndex: 2,
+			},
+		},
+		{
+			"no ISBN",
+			"content.opf",
+			`<dc:title>Notes</dc:title>
+			<dc:identifier id="id">urn:uuid:8b4c1a2e-1f3b-4c6e-9d2a-0e5f6a7b8c9d</dc:identifier>`,
+			&libris.Book{
+				Title:      "Notes",
+				Identifier: "8b4c1a2e-1f3b-4c6e-9d2a-0e5f6a7b8c9d", IdentifierType: "UUID",
+				Identifiers: map[string]string{"uuid": "8b4c1a2e-1f3b-4c6e-9d2a-0e5f6a7b8c9d"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "book.epub")
+			writeEPUB(t, p, test.opfPath, test.metadata)
+
+			b, err := readEPUBBook(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(b, test.want) {
+				t.Errorf("\n got %+v\nwant %+v", *b, *test.want)
+			}
+		})
+	}
+}
+
+func TestReadPDFBook(t *testing.T) {
+	tests := []struct {
+		name string
+		info string
+		want *libris.Book
+	}{
+		{
+			"semicolons",
+			"/Title (Dune) /Author (Frank Herbert; Brian Herbert) /Keywords (sf; classic)",
+			&libris.Book{Title: "Dune", Authors: []string{"Frank Herbert", "Brian Herbert"},
+				Tags: []string{"sf", "classic"}},
+		},
+		{
+			"commas",
+			"/Title ( The Hobbit ) /Author (J. R. R. Tolkien) /Keywords (fantasy, classic)",
+			&libris.Book{Title: "The Hobbit", Authors: []string{"J. R. R. Tolkien"},
+				Tags: []string{"fantasy", "classic"}},
+		},
+		{
+			"empty",
+			"/Producer (Nobody)",
+			&libris.Book{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "book.pdf")
+			writePDF(t, p, test.info)
+
+			b, err := readPDFBook(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(b, test.want) {
+				t.Errorf("\n got %+v\nwant %+v", *b, *test.want)
+			}
+		})
+	}
+}
+
+func TestReadFolderBookFallsBackToFileName(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "sub", "Broken Book.pdf")
+	writeFile(t, p, []byte("not a PDF"))
+
+	b := readFolderBook(t.Context(), p, filepath.Join("sub", "Broken Book.pdf"), "PDF")
+
+	want := &libris.Book{Title: "Broken Book", Identifier: "sub/Broken Book.pdf", IdentifierType: "FILE",
+		FileType: "PDF", Formats: []string{"PDF"}}
+	if !reflect.DeepEqual(b, want) {
+		t.Errorf("\n got %+v\nwant %+v", *b, *want)
+	}
+}
+
+func TestFolderScanCache(t *testing.T) {
+	dir := t.TempDir()
+	fp := newFolderProvider(dir)
+
+	titles := func() []string {
+		bs, err := fp.ListBooks(httptest.NewRequest("GET", "/folder/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var titles []string
+		for _, b := range bs {
+			titles = append(titles, b.Title)
+		}
+
+		return titles
+	}
+
+	dune, hobbit := filepath.Join(dir, "dune.pdf"), filepath.Join(dir, "hobbit.pdf")
+	writePDF(t, dune, "/Title (Dune)")
+	writePDF(t, hobbit, "/Title (The Hobbit)")
+	writeFile(t, filepath.Join(dir, "notes.txt"), []byte("not a book"))
+
+	steps := []struct {
+		name   string
+		change func()
+		want   []string
+	}{
+		{"first scan", func() {}, []string{"Dune", "The Hobbit"}},
+		{
+			"unchanged files aren't read again",
+			func() {
+				// XXX same size and modification time, so the cached metadata stays
+				info, _ := os.Stat(dune)
+				content, _ := os.ReadFile(dune)
+				writeFile(t, dune, bytes.Replace(content, []byte("(Dune)"), []byte("(Emma)"), 1))
+				os.Chtimes(dune, info.ModTime(), info.ModTime())
+			},
+			[]string{"Dune", "The Hobbit"},
+		},
+		{
+			"modified files are read again",
+			func() {
+				writePDF(t, dune, "/Title (Dune Messiah)")
+				later := time.Now().Add(time.Minute)
+				os.Chtimes(dune, later, later)
+			},
+			[]string{"Dune Messiah", "The Hobbit"},
+		},
+		{
+			"removed files are forgotten",
+			func() { os.Remove(hobbit) },
+			[]string{"Dune Messiah"},
+		},
+		{
+			"new files are read",
+			func() { writePDF(t, filepath.Join(dir, "more", "emma.pdf"), "/Title (Emma)") },
+			[]string{"Dune Messiah", "Emma"},
+		},
+	}
+
+	for _, step := range steps {
+		step.change()
+
+		if got := titles(); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: got %q, want %q", step.name, got, step.want)
+		}
+	}
+
+	if len(fp.files) != 2 {
+		t.Errorf("got %d files cached, want 2", len(fp.files))
+	}
+}
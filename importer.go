@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/hanjos/mea-libris/app"
+	"github.com/hanjos/mea-libris/libris"
+)
+
+// maxImportSize is the largest export accepted, in bytes.
+const maxImportSize = 32 << 20
+
+// importProvider serves books imported from a Goodreads or StoryGraph CSV export. Since Goodreads closed its API,
+// that's the only way to get at that data. Each upload replaces the previous one for the same user.
+type importProvider struct {
+	app.Router
+
+	store app.BookStore
+}
+
+func newImportProvider(store app.BookStore) *importProvider {
+	return &importProvider{
+		Router: app.NewRouter("/import"),
+		store:  store,
+	}
+}
+
+// Name implements the app.Provider interface.
+func (imp *importProvider) Name() string {
+	return "import"
+}
+
+// HandleBooks lists the user's imported books on a GET, and imports a new export on a POST. The export must be sent
+// as multipart/form-data, in the file field.
+func (imp *importProvider) HandleBooks(w http.ResponseWriter, r *http.Request) *app.Error {
+	switch r.Method {
+	case "GET", "HEAD":
+		return imp.listBooks(w, r)
+	case "POST":
+		return imp.importBooks(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		return app.Wrap(errMethodNotAllowed(r.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+func (imp *importProvider) listBooks(w http.ResponseWriter, r *http.Request) *app.Error {
+	bs, err := imp.ListBooks(r)
+	if err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	err = encodeBooks(bs, w, r)
+	if err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+// ListBooks implements the app.Lister interface.
+func (imp *importProvider) ListBooks(r *http.Request) (libris.Books, error) {
+	user := connection(r, imp.Name())
+	if user == "" {
+		return nil, app.Wrap(errNothingImported, http.StatusUnauthorized)
+	}
+
+	bs, ok, err := imp.store.Get(user)
+	if err != nil {
+		return nil, app.Wrap(errCantLoadImportedBooks(err), http.StatusInternalServerError)
+	} else if !ok {
+		return nil, app.Wrap(errNothingImported, http.StatusUnauthorized)
+	}
+
+	observeBooks(imp.Name(), bs)
+	return bs, nil
+}
+
+func (imp *importProvider) importBooks(w http.ResponseWriter, r *http.Request) *app.Error {
+	logFrom(r.Context()).Info("Reading the uploaded export")
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	file, _, err := r.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return app.Wrap(errExportTooLarge(tooLarge.Limit), http.StatusRequestEntityTooLarge)
+	} else if err != nil {
+		return app.Wrap(errExportNotFound(err), http.StatusBadRequest)
+	}
+	defer file.Close()
+
+	bs, skipped := libris.DecodeCSVExport(file)
+	if len(bs) == 0 && skipped != nil {
+		return app.Wrap(errCantImport(skipped), http.StatusBadRequest)
+	} else if skipped != nil {
+		logFrom(r.Context()).Warnf("Some rows couldn't be imported: %v", skipped)
+	}
+
+	user := connection(r, imp.Name())
+	if user == "" {
+		user = randomID()
+		if err := saveConnection(w, r, imp.Name(), user); err != nil {
+			return app.Wrap(err, http.StatusInternalServerError)
+		}
+	}
+
+	if err := imp.store.Put(user, bs); err != nil {
+		return app.Wrap(errCantStoreImportedBooks(err), http.StatusInternalServerError)
+	}
+
+	logFrom(r.Context()).Infof("%d books imported", len(bs))
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "%d books imported!\n", len(bs))
+	if skipped != nil {
+		fmt.Fprintf(w, "Some rows were skipped: %v\n", skipped)
+	}
+
+	return nil
+}
+
+// HandleConnect tells whether the user has imported anything, and how to do it.
+func (imp *importProvider) HandleConnect(w http.ResponseWriter, r *http.Request) *app.Error {
+	if user := connection(r, imp.Name()); user != "" {
+		if bs, ok, err := imp.store.Get(user); err == nil && ok {
+			fmt.Fprintf(w, "Connected! %d books imported.\n", len(bs))
+			return nil
+		}
+	}
+
+	fmt.Fprintf(w, "Nothing imported yet. POST a Goodreads or StoryGraph CSV export to %s, as multipart/form-data in "+
+		"the file field.\n", imp.Books())
+	return nil
+}
+
+// HandleDisconnect drops the user's imported books.
+func (imp *importProvider) HandleDisconnect(w http.ResponseWriter, r *http.Request) *app.Error {
+	user := connection(r, imp.Name())
+	if user == "" {
+		fmt.Fprintln(w, "User wasn't connected. Nothing was done.")
+		return nil
+	}
+
+	if err := imp.store.Delete(user); err != nil {
+		return app.Wrap(errCantStoreImportedBooks(err), http.StatusInternalServerError)
+	}
+
+	if err := saveConnection(w, r, imp.Name(), ""); err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	fmt.Fprintln(w, "Imported books dropped!")
+	return nil
+}
+
+// HandleOAuthCallback has nothing to do, since importing doesn't use OAuth.
+func (imp *importProvider) HandleOAuthCallback(w http.ResponseWriter, r *http.Request) *app.Error {
+	return app.Wrap(errNoOAuth(imp.Name()), http.StatusNotFound)
+}
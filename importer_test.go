@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hanjos/mea-libris/app"
+)
+
+// uploadRequest returns a POST to /import/ with the given export in the file field, followed by padding bytes.
+func uploadRequest(export string, padding int64) *http.Request {
+	var head bytes.Buffer
+	mw := multipart.NewWriter(&head)
+	part, _ := mw.CreateFormFile("file", "export.csv")
+	io.WriteString(part, export)
+
+	tail := "\r\n--" + mw.Boundary() + "--\r\n"
+	body := io.MultiReader(&head, io.LimitReader(zeros{}, padding), strings.NewReader(tail))
+
+	r := httptest.NewRequest("POST", "/import/", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// zeros is an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
+
+func TestImportBooks(t *testing.T) {
+	const export = "Book Id,Title,Author,ISBN,ISBN13,My Rating,Exclusive Shelf\n" +
+		`1,Dune,Frank Herbert,="0441172717",="9780441172719",5,read` + "\n"
+
+	tests := []struct {
+		name    string
+		export  string
+		padding int64
+		status  int
+	}{
+		{"an export", export, 0, http.StatusCreated},
+		{"not an export", "a,b\n1,2\n", 0, http.StatusBadRequest},
+		{"too large", export, maxImportSize, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			imp := newImportProvider(app.NewMemoryBookStore())
+
+			w := httptest.NewRecorder()
+			err := imp.HandleBooks(w, uploadRequest(test.export, test.padding))
+
+			status := w.Code
+			if err != nil {
+				status = err.Status
+			}
+
+			if status != test.status {
+				t.Errorf("got status %d (%v), want %d", status, err, test.status)
+			}
+		})
+	}
+}
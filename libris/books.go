@@ -2,11 +2,15 @@
 package libris
 
 import (
+	"crypto/sha1"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Book represents information about a volume.
@@ -15,10 +19,36 @@ type Book struct {
 	Authors        []string `json:"authors,omitempty"`
 	Identifier     string   `json:"identifier,omitempty"`
 	IdentifierType string   `json:"identifierType,omitempty"`
-	//MyRating int64	 `json:"myRating,omitempty"`
-	AverageRating float64 `json:"averageRating,omitempty"`
-	Publisher     string  `json:"publisher,omitempty"`
-	FileType      string  `json:"fileType,omitempty"`
+	MyRating       float64  `json:"myRating,omitempty"`
+	AverageRating  float64  `json:"averageRating,omitempty"`
+	Publisher      string   `json:"publisher,omitempty"`
+	FileType       string   `json:"fileType,omitempty"`
+
+	// How the user acquired this volume (e.g. PURCHASED, RENTED, UPLOADED), if known.
+	AcquisitionMethod string `json:"acquisitionMethod,omitempty"`
+	// The processing state of an uploaded volume (e.g. RUNNING, COMPLETED_SUCCESS). Empty for other volumes.
+	ProcessingState string `json:"processingState,omitempty"`
+	// The state of a rental, if this volume was rented.
+	RentalState string `json:"rentalState,omitempty"`
+	// When a rental expires, if this volume was rented.
+	RentalExpiry *time.Time `json:"rentalExpiry,omitempty"`
+
+	// The reading shelf this book is on (e.g. want-to-read, currently-reading, already-read), for providers which
+	// keep track of that.
+	Shelf string `json:"shelf,omitempty"`
+
+	// The series this book belongs to, if any, and its position there.
+	Series      string  `json:"series,omitempty"`
+	SeriesIndex float64 `json:"seriesIndex,omitempty"`
+	// Free-form labels attached to this book.
+	Tags []string `json:"tags,omitempty"`
+	// Every known identifier for this book, by type (e.g. isbn, goodreads, amazon). Identifier holds the main one.
+	Identifiers map[string]string `json:"identifiers,omitempty"`
+	// Every file format available for this book (e.g. EPUB, PDF, MOBI). FileType holds the preferred one.
+	Formats []string `json:"formats,omitempty"`
+
+	// The providers this book was found in (e.g. google, calibre), when books from several of them were merged.
+	Sources []string `json:"sources,omitempty"`
 }
 
 // marshalCSVRow returns the data in b as a CSV row.
@@ -27,12 +57,38 @@ func (b *Book) marshalCSVRow() []string {
 		fmt.Sprintf("%v", b.Title),
 		fmt.Sprintf("%v", strings.Join(b.Authors, ", ")),
 		fmt.Sprintf("%v", b.Identifier),
-		"", // myRating
+		formatRating(b.MyRating),
 		fmt.Sprintf("%.2f", b.AverageRating),
 		fmt.Sprintf("%v", b.Publisher),
+		fmt.Sprintf("%v", b.AcquisitionMethod),
+		fmt.Sprintf("%v", b.ProcessingState),
+		fmt.Sprintf("%v", b.RentalState),
+		formatTime(b.RentalExpiry),
+		fmt.Sprintf("%v", b.Shelf),
+		fmt.Sprintf("%v", b.Series),
+		fmt.Sprintf("%v", strings.Join(b.Tags, ", ")),
+		fmt.Sprintf("%v", strings.Join(b.Sources, ", ")),
 	}
 }
 
+// formatTime returns a time as an RFC 3339 CSV field, where nil means unknown.
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+// formatRating returns a rating as a CSV field, where 0 means unrated.
+func formatRating(rating float64) string {
+	if rating == 0 {
+		return ""
+	}
+
+	return strconv.FormatFloat(rating, 'f', -1, 64)
+}
+
 // Books is an alias for a slice of *Book, for methods to hang onto.
 type Books []*Book
 
@@ -40,7 +96,8 @@ type Books []*Book
 func (bs Books) marshalCSV() [][]string {
 	result := [][]string{}
 
-	result = append(result, []string{"Title", "Author", "ISBN", "My Rating", "Average Rating", "Publisher"})
+	result = append(result, []string{"Title", "Author", "ISBN", "My Rating", "Average Rating", "Publisher",
+		"Acquisition Method", "Processing State", "Rental State", "Rental Expiry", "Shelf", "Series", "Tags", "Sources"})
 
 	for _, b := range bs {
 		result = append(result, b.marshalCSVRow())
@@ -89,6 +146,17 @@ func (bs Books) EncodeJSON(writer io.Writer) error {
 	return nil
 }
 
+// ETag returns a weak entity tag identifying the contents of bs, suitable for HTTP conditional requests. Equal book
+// sets, in the same order, have equal tags.
+func (bs Books) ETag() string {
+	h := sha1.New()
+
+	// XXX encoding a slice of structs won't fail
+	json.NewEncoder(h).Encode(bs)
+
+	return `W/"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
 // Notification implements Martin Fowler's Notification design pattern
 // (http://martinfowler.com/articles/replaceThrowWithNotification.html ).
 //
@@ -0,0 +1,57 @@
+package libris
+
+import (
+	"bytes"
+	"encoding/csv"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBooksEncodeCSV(t *testing.T) {
+	expiry := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	bs := Books{
+		{
+			Title:             "Dune",
+			Authors:           []string{"Frank Herbert", "Brian Herbert"},
+			Identifier:        "9780441172719",
+			MyRating:          4.5,
+			AverageRating:     4.25,
+			Publisher:         "Ace",
+			AcquisitionMethod: "RENTED",
+			RentalState:       "RENTED",
+			RentalExpiry:      &expiry,
+			Shelf:             "currently-reading",
+			Series:            "Dune",
+			Tags:              []string{"sf", "classic"},
+			Sources:           []string{"google", "calibre"},
+		},
+		{
+			Title:             "Notes",
+			AcquisitionMethod: "UPLOADED",
+			ProcessingState:   "RUNNING",
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := bs.EncodeCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{"Title", "Author", "ISBN", "My Rating", "Average Rating", "Publisher", "Acquisition Method",
+			"Processing State", "Rental State", "Rental Expiry", "Shelf", "Series", "Tags", "Sources"},
+		{"Dune", "Frank Herbert, Brian Herbert", "9780441172719", "4.5", "4.25", "Ace", "RENTED", "", "RENTED",
+			"2024-01-31T12:00:00Z", "currently-reading", "Dune", "sf, classic", "google, calibre"},
+		{"Notes", "", "", "", "0.00", "", "UPLOADED", "RUNNING", "", "", "", "", "", ""},
+	}
+
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("got %q, want %q", records, want)
+	}
+}
@@ -0,0 +1,113 @@
+package libris
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Changes is what changed between two sets of books.
+type Changes struct {
+	Added    Books `json:"added"`
+	Removed  Books `json:"removed"`
+	Modified Books `json:"modified"`
+}
+
+// Diff returns what changed from old to new. Books are told apart by key, which should return something unique and
+// stable for each book (e.g. a provider's own ID); books for which it returns "" can't be tracked, and are left out.
+// Added and modified books are in new's order, and hold new's data; removed books are in old's order.
+func Diff(old, new Books, key func(b *Book) string) *Changes {
+	before := map[string]*Book{}
+	for _, b := range old {
+		if k := key(b); k != "" {
+			before[k] = b
+		}
+	}
+
+	changes := &Changes{Added: Books{}, Removed: Books{}, Modified: Books{}}
+	after := map[string]bool{}
+	for _, b := range new {
+		k := key(b)
+		if k == "" {
+			continue
+		}
+
+		after[k] = true
+		if prev, ok := before[k]; !ok {
+			changes.Added = append(changes.Added, b)
+		} else if !sameBook(prev, b) {
+			changes.Modified = append(changes.Modified, b)
+		}
+	}
+
+	for _, b := range old {
+		if k := key(b); k != "" && !after[k] {
+			changes.Removed = append(changes.Removed, b)
+		}
+	}
+
+	return changes
+}
+
+// IsEmpty returns true if nothing changed.
+func (c *Changes) IsEmpty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Modified) == 0
+}
+
+// sameBook returns true if a and b hold the same data.
+func sameBook(a, b *Book) bool {
+	// XXX encoding a struct of plain values won't fail
+	aJSON, _ := json.Marshal(a)
+	bJSON, _ := json.Marshal(b)
+
+	return string(aJSON) == string(bJSON)
+}
+
+// EncodeCSV writes the changes to the given io.Writer as CSV: the same columns as Books.EncodeCSV, preceded by a
+// Change column holding added, removed or modified. Returns all errors found bundled in a single error, or nil if
+// everything went ok.
+func (c *Changes) EncodeCSV(writer io.Writer) error {
+	w := csv.NewWriter(writer)
+	n := &notification{}
+
+	header := Books{}.marshalCSV()[0]
+	if err := w.Write(append([]string{"Change"}, header...)); err != nil {
+		n.Report(err)
+	}
+
+	for _, group := range []struct {
+		change string
+		books  Books
+	}{{"added", c.Added}, {"removed", c.Removed}, {"modified", c.Modified}} {
+		for _, b := range group.books {
+			if err := w.Write(append([]string{group.change}, b.marshalCSVRow()...)); err != nil {
+				n.Report(err)
+			}
+		}
+	}
+
+	w.Flush()
+
+	if err := w.Error(); err != nil {
+		n.Report(err)
+	}
+
+	return n.ToError()
+}
+
+// EncodeJSON writes the changes to the given io.Writer as JSON. Returns all errors found bundled in a single error,
+// or nil if everything went ok.
+func (c *Changes) EncodeJSON(writer io.Writer) error {
+	changesJSON, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(writer, "%s", changesJSON)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package libris
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	byID := func(b *Book) string { return b.Identifiers["id"] }
+	book := func(id, title string) *Book {
+		b := &Book{Title: title}
+		if id != "" {
+			b.Identifiers = map[string]string{"id": id}
+		}
+
+		return b
+	}
+
+	tests := []struct {
+		name                     string
+		old, new                 Books
+		added, removed, modified []string // titles, in order
+	}{
+		{"nothing", nil, nil, nil, nil, nil},
+		{"same books", Books{book("1", "Dune"), book("2", "Emma")}, Books{book("2", "Emma"), book("1", "Dune")},
+			nil, nil, nil},
+		{"from nothing", nil, Books{book("1", "Dune"), book("2", "Emma")}, []string{"Dune", "Emma"}, nil, nil},
+		{"to nothing", Books{book("1", "Dune"), book("2", "Emma")}, nil, nil, []string{"Dune", "Emma"}, nil},
+		{
+			"added, removed and modified",
+			Books{book("1", "Dune"), book("2", "Emma"), book("3", "The Hobbit")},
+			Books{book("4", "Beowulf"), book("3", "The Hobbit (Illustrated)"), book("1", "Dune")},
+			[]string{"Beowulf"}, []string{"Emma"}, []string{"The Hobbit (Illustrated)"},
+		},
+		{
+			"same title, another key",
+			Books{book("1", "Dune")},
+			Books{book("2", "Dune")},
+			[]string{"Dune"}, []string{"Dune"}, nil,
+		},
+		{
+			"books without keys are left out",
+			Books{book("", "Emma"), book("1", "Dune")},
+			Books{book("", "Beowulf"), book("1", "Dune Messiah")},
+			nil, nil, []string{"Dune Messiah"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes := Diff(test.old, test.new, byID)
+
+			for _, group := range []struct {
+				name string
+				got  Books
+				want []string
+			}{
+				{"added", changes.Added, test.added},
+				{"removed", changes.Removed, test.removed},
+				{"modified", changes.Modified, test.modified},
+			} {
+				var got []string
+				for _, b := range group.got {
+					got = append(got, b.Title)
+				}
+
+				if len(got) != len(group.want) {
+					t.Errorf("%s: got %q, want %q", group.name, got, group.want)
+					continue
+				}
+
+				for i := range got {
+					if got[i] != group.want[i] {
+						t.Errorf("%s: got %q, want %q", group.name, got, group.want)
+						break
+					}
+				}
+			}
+
+			wantEmpty := len(test.added)+len(test.removed)+len(test.modified) == 0
+			if changes.IsEmpty() != wantEmpty {
+				t.Errorf("got IsEmpty %t, want %t", changes.IsEmpty(), wantEmpty)
+			}
+		})
+	}
+}
+
+func TestChangesEncodeCSV(t *testing.T) {
+	changes := &Changes{
+		Added:    Books{{Title: "Beowulf"}},
+		Removed:  Books{{Title: "Emma"}},
+		Modified: Books{{Title: "Dune"}},
+	}
+
+	var buf bytes.Buffer
+	if err := changes.EncodeCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 4 {
+		t.Fatalf("got %d rows, want 4", len(records))
+	}
+
+	if records[0][0] != "Change" || records[0][1] != "Title" {
+		t.Errorf("got the header %q", records[0])
+	}
+
+	for i, want := range [][2]string{{"added", "Beowulf"}, {"removed", "Emma"}, {"modified", "Dune"}} {
+		if got := records[i+1]; got[0] != want[0] || got[1] != want[1] {
+			t.Errorf("row %d: got %q, want it to start with %q", i+1, got, want)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package libris
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DecodeCSVExport reads the books in a Goodreads or StoryGraph CSV export from the given io.Reader. Which one it is
+// is told by the header row. Rows which can't be read are skipped, and reported bundled in a single error, along with
+// the books read; a nil error means everything went ok.
+func DecodeCSVExport(reader io.Reader) (Books, error) {
+	r := csv.NewReader(reader)
+	r.FieldsPerRecord = -1 // XXX exports aren't always consistent
+	r.LazyQuotes = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read the header: %v", err)
+	}
+
+	columns := newCSVColumns(header)
+
+	var parse func(row csvRow) (*Book, error)
+	switch {
+	case columns.has("Book Id", "Exclusive Shelf"):
+		parse = parseGoodreadsRow
+	case columns.has("ISBN/UID", "Read Status"):
+		parse = parseStoryGraphRow
+	default:
+		return nil, fmt.Errorf("Unknown export format; expected a Goodreads or StoryGraph CSV export")
+	}
+
+	bs := Books{}
+	n := &notification{}
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			n.Report(fmt.Errorf("Line %d: %v", line, err))
+			if _, ok := err.(*csv.ParseError); ok {
+				continue
+			}
+
+			break
+		}
+
+		b, err := parse(csvRow{columns, record})
+		if err != nil {
+			n.Report(fmt.Errorf("Line %d: %v", line, err))
+			continue
+		}
+
+		bs = append(bs, b)
+	}
+
+	return bs, n.ToError()
+}
+
+// parseGoodreadsRow reads a row from a Goodreads export.
+func parseGoodreadsRow(row csvRow) (*Book, error) {
+	title := row.get("Title")
+	if title == "" {
+		return nil, fmt.Errorf("No title")
+	}
+
+	authors := []string{}
+	if author := row.get("Author"); author != "" {
+		authors = append(authors, author)
+	}
+	authors = append(authors, splitList(row.get("Additional Authors"))...)
+
+	b := &Book{
+		Title:     title,
+		Authors:   authors,
+		Publisher: row.get("Publisher"),
+		Shelf:     row.get("Exclusive Shelf"),
+	}
+
+	b.Identifier, b.IdentifierType = isbn(row.get("ISBN13"), row.get("ISBN"))
+	if b.Identifier == "" {
+		b.Identifier, b.IdentifierType = row.get("Book Id"), "GOODREADS"
+	}
+
+	var err error
+	if b.MyRating, err = parseRating(row.get("My Rating")); err != nil {
+		return nil, err
+	}
+
+	if b.AverageRating, err = parseRating(row.get("Average Rating")); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// parseStoryGraphRow reads a row from a StoryGraph export.
+func parseStoryGraphRow(row csvRow) (*Book, error) {
+	title := row.get("Title")
+	if title == "" {
+		return nil, fmt.Errorf("No title")
+	}
+
+	b := &Book{
+		Title:   title,
+		Authors: splitList(row.get("Authors")),
+		Shelf:   row.get("Read Status"),
+	}
+
+	b.Identifier, b.IdentifierType = isbn(row.get("ISBN/UID"))
+	if b.Identifier == "" {
+		b.Identifier, b.IdentifierType = row.get("ISBN/UID"), "STORYGRAPH"
+	}
+
+	var err error
+	if b.MyRating, err = parseRating(row.get("Star Rating")); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// csvColumns maps a header's column names to their positions.
+type csvColumns map[string]int
+
+func newCSVColumns(header []string) csvColumns {
+	columns := csvColumns{}
+	for i, name := range header {
+		// XXX some exports start with a byte order mark
+		columns[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+	}
+
+	return columns
+}
+
+// has returns true if every given column is present.
+func (c csvColumns) has(names ...string) bool {
+	for _, name := range names {
+		if _, ok := c[name]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// csvRow is a record, whose fields can be read by column name.
+type csvRow struct {
+	columns csvColumns
+	record  []string
+}
+
+// get returns the trimmed value in the given column, or "" if there's no such column.
+func (r csvRow) get(column string) string {
+	i, ok := r.columns[column]
+	if !ok || i >= len(r.record) {
+		return ""
+	}
+
+	return strings.TrimSpace(r.record[i])
+}
+
+// isbn returns the first valid ISBN among the candidates, and its type (ISBN_13 or ISBN_10). Goodreads writes them
+// as ="9780000000000", so that spreadsheets don't mangle them; that is removed.
+func isbn(candidates ...string) (string, string) {
+	for _, candidate := range candidates {
+		candidate = strings.Trim(strings.TrimPrefix(candidate, "="), `"`)
+		candidate = strings.Replace(candidate, "-", "", -1)
+
+		switch {
+		case len(candidate) == 13 && isDigits(candidate):
+			return candidate, "ISBN_13"
+		case len(candidate) == 10 && isDigits(candidate[:9]) && (isDigits(candidate[9:]) || candidate[9] == 'X'):
+			return candidate, "ISBN_10"
+		}
+	}
+
+	return "", ""
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return s != ""
+}
+
+// parseRating reads a rating, where an empty value or 0 mean unrated.
+func parseRating(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	rating, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid rating %q", s)
+	}
+
+	return rating, nil
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
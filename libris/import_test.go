@@ -0,0 +1,112 @@
+package libris
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCSVExport(t *testing.T) {
+	tests := []struct {
+		name    string
+		export  string
+		want    Books
+		skipped int
+	}{
+		{
+			"Goodreads",
+			"Book Id,Title,Author,Additional Authors,ISBN,ISBN13,My Rating,Average Rating,Publisher,Exclusive Shelf\n" +
+				`234225,Dune,Frank Herbert,,="0441172717",="9780441172719",5,4.27,Ace,read` + "\n" +
+				`44767458,Dune Messiah,Frank Herbert,"Brian Herbert, Kevin J. Anderson",="",="",0,3.89,,to-read` + "\n",
+			Books{
+				{Title: "Dune", Authors: []string{"Frank Herbert"}, Identifier: "9780441172719",
+					IdentifierType: "ISBN_13", MyRating: 5, AverageRating: 4.27, Publisher: "Ace", Shelf: "read"},
+				{Title: "Dune Messiah", Authors: []string{"Frank Herbert", "Brian Herbert", "Kevin J. Anderson"},
+					Identifier: "44767458", IdentifierType: "GOODREADS", AverageRating: 3.89, Shelf: "to-read"},
+			},
+			0,
+		},
+		{
+			"Goodreads, ISBN-10 only",
+			"Book Id,Title,Author,ISBN,ISBN13,My Rating,Exclusive Shelf\n" +
+				`1,Dune,Frank Herbert,="044117271X",="",,read` + "\n",
+			Books{
+				{Title: "Dune", Authors: []string{"Frank Herbert"}, Identifier: "044117271X",
+					IdentifierType: "ISBN_10", Shelf: "read"},
+			},
+			0,
+		},
+		{
+			"Goodreads, with a byte order mark",
+			"\ufeffBook Id,Title,Author,ISBN,ISBN13,My Rating,Exclusive Shelf\n" +
+				`1,Dune,Frank Herbert,="",="9780441172719",,read` + "\n",
+			Books{
+				{Title: "Dune", Authors: []string{"Frank Herbert"}, Identifier: "9780441172719",
+					IdentifierType: "ISBN_13", Shelf: "read"},
+			},
+			0,
+		},
+		{
+			"StoryGraph",
+			"Title,Authors,Contributors,ISBN/UID,Format,Read Status,Star Rating\n" +
+				"Dune,Frank Herbert,,9780441172719,paperback,read,4.5\n" +
+				`The Mirror & the Light,"Hilary Mantel, Ben Miles",,a1b2c3,audio,currently-reading,` + "\n",
+			Books{
+				{Title: "Dune", Authors: []string{"Frank Herbert"}, Identifier: "9780441172719",
+					IdentifierType: "ISBN_13", MyRating: 4.5, Shelf: "read"},
+				{Title: "The Mirror & the Light", Authors: []string{"Hilary Mantel", "Ben Miles"},
+					Identifier: "a1b2c3", IdentifierType: "STORYGRAPH", Shelf: "currently-reading"},
+			},
+			0,
+		},
+		{
+			"rows without titles or with invalid ratings are skipped",
+			"Title,Authors,ISBN/UID,Read Status,Star Rating\n" +
+				",Nobody,,read,\n" +
+				"Dune,Frank Herbert,,read,five\n" +
+				"Emma,Jane Austen,,to-read,\n",
+			Books{
+				{Title: "Emma", Authors: []string{"Jane Austen"}, Shelf: "to-read", IdentifierType: "STORYGRAPH"},
+			},
+			2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bs, err := DecodeCSVExport(strings.NewReader(test.export))
+
+			if test.skipped == 0 && err != nil {
+				t.Errorf("got the error %v", err)
+			} else if test.skipped > 0 {
+				if err == nil {
+					t.Errorf("got no error, want %d rows skipped", test.skipped)
+				} else if got := strings.Count(err.Error(), "Line "); got != test.skipped {
+					t.Errorf("got %d rows skipped (%v), want %d", got, err, test.skipped)
+				}
+			}
+
+			if !reflect.DeepEqual(bs, test.want) {
+				t.Errorf("got %s, want %s", describeBooks(bs), describeBooks(test.want))
+			}
+		})
+	}
+}
+
+func TestDecodeCSVExportUnknownFormat(t *testing.T) {
+	for _, export := range []string{"", "Name,Value\nDune,1\n"} {
+		if bs, err := DecodeCSVExport(strings.NewReader(export)); err == nil {
+			t.Errorf("%q: got %d books and no error", export, len(bs))
+		}
+	}
+}
+
+func describeBooks(bs Books) string {
+	var descriptions []string
+	for _, b := range bs {
+		descriptions = append(descriptions, strings.TrimSpace(strings.Join(b.marshalCSVRow(), "|"))+
+			" ("+b.IdentifierType+")")
+	}
+
+	return "[" + strings.Join(descriptions, "; ") + "]"
+}
@@ -0,0 +1,343 @@
+package libris
+
+import (
+	"strings"
+	"unicode"
+)
+
+// titleSimilarity is how similar two normalized titles must be, from 0 to 1, for books by the same author to be
+// considered the same.
+const titleSimilarity = 0.9
+
+// Library merges books from several sources, so that a book found in more than one of them shows up only once. Books
+// are the same if they share an ISBN (ISBN-10s and ISBN-13s are compared as ISBN-13s), or if they share an author and
+// their titles are nearly the same, ignoring case, punctuation, leading articles and subtitles.
+//
+// The books given are never modified; merged books are copies.
+type Library struct {
+	books Books
+
+	// every book, by normalized ISBN, author surname and normalized title
+	byISBN   map[string]*Book
+	byAuthor map[string][]*Book
+	byTitle  map[string][]*Book
+}
+
+// NewLibrary creates an empty Library.
+func NewLibrary() *Library {
+	return &Library{
+		books:    Books{},
+		byISBN:   map[string]*Book{},
+		byAuthor: map[string][]*Book{},
+		byTitle:  map[string][]*Book{},
+	}
+}
+
+// Add merges the books from the given source into this library. Each book's Sources gets the source's name.
+func (l *Library) Add(source string, bs Books) {
+	for _, b := range bs {
+		if b == nil {
+			continue
+		}
+
+		if match := l.find(b); match != nil {
+			mergeBook(match, b, source)
+			l.index(match)
+			continue
+		}
+
+		c := copyBook(b)
+		c.Sources = []string{source}
+		l.books = append(l.books, c)
+		l.index(c)
+	}
+}
+
+// Books returns the merged books, in the order they were first added.
+func (l *Library) Books() Books {
+	return l.books
+}
+
+// find returns the book in this library which is the same as b, or nil if there's none.
+func (l *Library) find(b *Book) *Book {
+	isbn := normalizedISBN(b)
+	if isbn != "" {
+		if match, ok := l.byISBN[isbn]; ok {
+			return match
+		}
+	}
+
+	// XXX books with different ISBNs are different editions, which are kept apart
+	differentEdition := func(candidate *Book) bool {
+		other := normalizedISBN(candidate)
+		return isbn != "" && other != "" && isbn != other
+	}
+
+	title := normalizeTitle(b.Title)
+	if title == "" {
+		return nil
+	}
+
+	// XXX without authors on either side, only the title is left to go by
+	surnames := authorSurnames(b.Authors)
+	for _, candidate := range l.byTitle[title] {
+		if (len(surnames) == 0 || len(candidate.Authors) == 0) && !differentEdition(candidate) {
+			return candidate
+		}
+	}
+
+	for _, surname := range surnames {
+		for _, candidate := range l.byAuthor[surname] {
+			if !differentEdition(candidate) && similarity(title, normalizeTitle(candidate.Title)) >= titleSimilarity {
+				return candidate
+			}
+		}
+	}
+
+	return nil
+}
+
+// index makes b findable by its ISBN, authors and title.
+func (l *Library) index(b *Book) {
+	if isbn := normalizedISBN(b); isbn != "" {
+		if _, ok := l.byISBN[isbn]; !ok {
+			l.byISBN[isbn] = b
+		}
+	}
+
+	if title := normalizeTitle(b.Title); title != "" {
+		l.byTitle[title] = appendBook(l.byTitle[title], b)
+	}
+
+	for _, surname := range authorSurnames(b.Authors) {
+		l.byAuthor[surname] = appendBook(l.byAuthor[surname], b)
+	}
+}
+
+// appendBook appends b to bs, unless it's already there.
+func appendBook(bs []*Book, b *Book) []*Book {
+	for _, other := range bs {
+		if other == b {
+			return bs
+		}
+	}
+
+	return append(bs, b)
+}
+
+// copyBook returns a copy of b which can be merged into without touching b.
+func copyBook(b *Book) *Book {
+	c := *b
+	c.Authors = append([]string(nil), b.Authors...)
+	c.Tags = append([]string(nil), b.Tags...)
+	c.Formats = append([]string(nil), b.Formats...)
+	c.Sources = nil
+
+	if b.Identifiers != nil {
+		c.Identifiers = map[string]string{}
+		for idType, value := range b.Identifiers {
+			c.Identifiers[idType] = value
+		}
+	}
+
+	return &c
+}
+
+// mergeBook fills in what dst is missing from src, and adds src's source. Whatever dst already has wins.
+func mergeBook(dst, src *Book, source string) {
+	dst.Sources = appendUnique(dst.Sources, source)
+
+	if len(dst.Authors) == 0 {
+		dst.Authors = append([]string(nil), src.Authors...)
+	}
+
+	if dst.Identifier == "" {
+		dst.Identifier, dst.IdentifierType = src.Identifier, src.IdentifierType
+	}
+
+	if dst.MyRating == 0 {
+		dst.MyRating = src.MyRating
+	}
+
+	if dst.AverageRating == 0 {
+		dst.AverageRating = src.AverageRating
+	}
+
+	if dst.Publisher == "" {
+		dst.Publisher = src.Publisher
+	}
+
+	if dst.FileType == "" || dst.FileType == "UNKNOWN" {
+		dst.FileType = src.FileType
+	}
+
+	if dst.Shelf == "" {
+		dst.Shelf = src.Shelf
+	}
+
+	if dst.Series == "" {
+		dst.Series, dst.SeriesIndex = src.Series, src.SeriesIndex
+	}
+
+	for _, tag := range src.Tags {
+		dst.Tags = appendUnique(dst.Tags, tag)
+	}
+
+	for _, format := range src.Formats {
+		dst.Formats = appendUnique(dst.Formats, format)
+	}
+
+	for idType, value := range src.Identifiers {
+		if dst.Identifiers == nil {
+			dst.Identifiers = map[string]string{}
+		}
+
+		if _, ok := dst.Identifiers[idType]; !ok {
+			dst.Identifiers[idType] = value
+		}
+	}
+}
+
+// appendUnique appends s to ss, unless it's already there.
+func appendUnique(ss []string, s string) []string {
+	for _, other := range ss {
+		if other == s {
+			return ss
+		}
+	}
+
+	return append(ss, s)
+}
+
+// normalizedISBN returns b's ISBN as an ISBN-13, or "" if it has no valid one.
+func normalizedISBN(b *Book) string {
+	candidates := []string{b.Identifiers["isbn"], b.Identifiers["isbn13"], b.Identifiers["isbn10"]}
+	if strings.HasPrefix(b.IdentifierType, "ISBN") {
+		candidates = append([]string{b.Identifier}, candidates...)
+	}
+
+	for _, candidate := range candidates {
+		if value, idType := isbn(candidate); idType == "ISBN_13" {
+			return value
+		} else if idType == "ISBN_10" {
+			return isbn10To13(value)
+		}
+	}
+
+	return ""
+}
+
+// isbn10To13 converts a valid ISBN-10 to its ISBN-13.
+func isbn10To13(isbn10 string) string {
+	digits := "978" + isbn10[:9]
+
+	sum := 0
+	for i, c := range digits {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+
+		sum += int(c-'0') * weight
+	}
+
+	return digits + string(rune('0'+(10-sum%10)%10))
+}
+
+// titleArticles are dropped from the start of titles before comparing them.
+var titleArticles = []string{"the ", "a ", "an "}
+
+// normalizeTitle reduces a title to what matters for comparisons: lowercase letters and digits, separated by single
+// spaces, without subtitles or leading articles.
+func normalizeTitle(title string) string {
+	if i := strings.IndexAny(title, ":;("); i > 0 {
+		title = title[:i]
+	}
+
+	title = normalizeWords(title)
+	for _, article := range titleArticles {
+		if strings.HasPrefix(title, article) {
+			title = title[len(article):]
+			break
+		}
+	}
+
+	return title
+}
+
+// authorSurnames returns the normalized surnames of the given authors, taken to be the last word of each name, or
+// the first, for names written as "Surname, Name".
+func authorSurnames(authors []string) []string {
+	var surnames []string
+	for _, author := range authors {
+		if i := strings.Index(author, ","); i > 0 {
+			author = author[:i]
+		}
+
+		words := strings.Fields(normalizeWords(author))
+		if len(words) > 0 {
+			surnames = appendUnique(surnames, words[len(words)-1])
+		}
+	}
+
+	return surnames
+}
+
+// normalizeWords lowercases s and replaces anything other than letters and digits with single spaces.
+func normalizeWords(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	}), " ")
+}
+
+// similarity returns how similar a and b are, from 0 (nothing in common) to 1 (equal), based on their edit distance.
+func similarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+
+	if c < a {
+		a = c
+	}
+
+	return a
+}
@@ -0,0 +1,175 @@
+package libris
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestLibraryAdd(t *testing.T) {
+	tests := []struct {
+		name   string
+		a, b   Book
+		merged bool
+	}{
+		{
+			"ISBN-10 and ISBN-13 of the same book",
+			Book{Title: "Dune", Identifier: "0441172717", IdentifierType: "ISBN_10"},
+			Book{Title: "Dune (40th Anniversary Edition)", Identifiers: map[string]string{"isbn13": "978-0-441-17271-9"}},
+			true,
+		},
+		{
+			"same ISBN, different titles and authors",
+			Book{Title: "Dune", Authors: []string{"Frank Herbert"}, Identifier: "9780441172719", IdentifierType: "ISBN_13"},
+			Book{Title: "Duna", Authors: []string{"F. Herbert"}, Identifiers: map[string]string{"isbn": "9780441172719"}},
+			true,
+		},
+		{
+			"different ISBNs, same title and author",
+			Book{Title: "Dune", Authors: []string{"Frank Herbert"}, Identifier: "0441172717", IdentifierType: "ISBN_10"},
+			Book{Title: "Dune", Authors: []string{"Frank Herbert"}, Identifier: "9780340960196", IdentifierType: "ISBN_13"},
+			false,
+		},
+		{
+			"same title, different authors",
+			Book{Title: "Emma", Authors: []string{"Jane Austen"}},
+			Book{Title: "Emma", Authors: []string{"Charlotte Brontë"}},
+			false,
+		},
+		{
+			"near-identical titles, different authors",
+			Book{Title: "The Stand", Authors: []string{"Stephen King"}},
+			Book{Title: "The Strand", Authors: []string{"Rosemary Sutcliff"}},
+			false,
+		},
+		{
+			"near-identical titles, same author, no ISBNs",
+			Book{Title: "Harry Potter and the Philosopher's Stone", Authors: []string{"J. K. Rowling"}},
+			Book{Title: "Harry Potter and the Philosophers Stone", Authors: []string{"Rowling, J.K."}},
+			true,
+		},
+		{
+			"same title but for article, case and subtitle, same author, no ISBNs",
+			Book{Title: "The Hobbit", Authors: []string{"J.R.R. Tolkien"}},
+			Book{Title: "hobbit: or There and Back Again", Authors: []string{"John Ronald Reuel Tolkien"}},
+			true,
+		},
+		{
+			"dissimilar titles, same author, no ISBNs",
+			Book{Title: "Dune", Authors: []string{"Frank Herbert"}},
+			Book{Title: "Dune Messiah", Authors: []string{"Frank Herbert"}},
+			false,
+		},
+		{
+			"same title, no authors on one side, no ISBNs",
+			Book{Title: "Beowulf"},
+			Book{Title: "Beowulf", Authors: []string{"Seamus Heaney"}},
+			true,
+		},
+		{
+			"same title, no authors on one side, different ISBNs",
+			Book{Title: "Beowulf", Identifier: "9780393320978", IdentifierType: "ISBN_13"},
+			Book{Title: "Beowulf", Authors: []string{"Seamus Heaney"}, Identifier: "9780140449310",
+				IdentifierType: "ISBN_13"},
+			false,
+		},
+		{
+			"same title, no authors, ISBN on one side",
+			Book{Title: "Beowulf", Identifier: "9780393320978", IdentifierType: "ISBN_13"},
+			Book{Title: "Beowulf"},
+			true,
+		},
+		{
+			"different titles, no authors, no ISBNs",
+			Book{Title: "Beowulf"},
+			Book{Title: "Gilgamesh"},
+			false,
+		},
+		{
+			"no titles, no authors, no ISBNs",
+			Book{},
+			Book{},
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := test.a, test.b
+
+			l := NewLibrary()
+			l.Add("a", Books{&a})
+			l.Add("b", Books{&b})
+
+			bs := l.Books()
+			if test.merged {
+				if len(bs) != 1 {
+					t.Fatalf("got %d books, want 1", len(bs))
+				}
+
+				if want := []string{"a", "b"}; !reflect.DeepEqual(bs[0].Sources, want) {
+					t.Errorf("got sources %v, want %v", bs[0].Sources, want)
+				}
+
+				if bs[0].Title != test.a.Title {
+					t.Errorf("got title %q, want the first source's %q", bs[0].Title, test.a.Title)
+				}
+			} else if len(bs) != 2 {
+				t.Fatalf("got %d books, want 2", len(bs))
+			}
+
+			if a.Sources != nil || b.Sources != nil {
+				t.Errorf("the books given were modified")
+			}
+		})
+	}
+}
+
+func TestNormalizedISBN(t *testing.T) {
+	tests := []struct {
+		name string
+		book Book
+		want string
+	}{
+		{"ISBN-13", Book{Identifier: "9780441172719", IdentifierType: "ISBN_13"}, "9780441172719"},
+		{"ISBN-10", Book{Identifier: "0441172717", IdentifierType: "ISBN_10"}, "9780441172719"},
+		{"ISBN-10 ending in X", Book{Identifier: "080442957X", IdentifierType: "ISBN_10"}, "9780804429573"},
+		{"hyphenated", Book{Identifier: "0-441-17271-7", IdentifierType: "ISBN_10"}, "9780441172719"},
+		{"in Identifiers", Book{Identifiers: map[string]string{"isbn10": "0441172717"}}, "9780441172719"},
+		{"identifier isn't an ISBN", Book{Identifier: "9780441172719", IdentifierType: "GOOGLE"}, ""},
+		{"invalid", Book{Identifier: "044117271", IdentifierType: "ISBN_10"}, ""},
+		{"none", Book{}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := normalizedISBN(&test.book); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"dune", "dune", 1},
+		{"", "", 1},
+		{"dune", "", 0},
+		{"abcd", "wxyz", 0},
+		{"stand", "strand", 5.0 / 6},
+		{"philosopher s stone", "philosophers stone", 18.0 / 19},
+	}
+
+	for _, test := range tests {
+		if got := similarity(test.a, test.b); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("similarity(%q, %q): got %v, want %v", test.a, test.b, got, test.want)
+		}
+
+		if got := similarity(test.b, test.a); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("similarity(%q, %q): got %v, want %v", test.b, test.a, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/hanjos/mea-libris/app"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// logger is where everything is logged. It writes logfmt at the info level until main configures it.
+var logger = &logrus.Logger{
+	Out:       os.Stdout,
+	Formatter: logFormats["logfmt"],
+	Hooks:     logrus.LevelHooks{},
+	Level:     logrus.InfoLevel,
+}
+
+// logFormats are how log lines can be written, by name. No date or time; an external router can consume this log and
+// provide that.
+var logFormats = map[string]logrus.Formatter{
+	"logfmt": &logrus.TextFormatter{DisableColors: true, DisableTimestamp: true, QuoteEmptyFields: true},
+	"json":   &logrus.JSONFormatter{DisableTimestamp: true},
+}
+
+// logFormatNames are the keys of logFormats, sorted.
+var logFormatNames = []string{"json", "logfmt"}
+
+// logLevels are the levels which can be logged from, by name.
+var logLevels = map[string]logrus.Level{
+	"debug": logrus.DebugLevel,
+	"info":  logrus.InfoLevel,
+	"warn":  logrus.WarnLevel,
+	"error": logrus.ErrorLevel,
+}
+
+// logLevelNames are the keys of logLevels, from the most verbose.
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// configureLogger sets the logger's format and level to the given ones, which Validate already checked.
+func configureLogger(format, level string) {
+	logger.SetFormatter(logFormats[format])
+	logger.SetLevel(logLevels[level])
+}
+
+// logFrom returns the logger of the request ctx belongs to, which tags every line with the request's ID, or one with
+// no tags at all, for background work.
+func logFrom(ctx context.Context) *logrus.Entry {
+	if entry, ok := app.LoggerFrom(ctx, nil).(*logrus.Entry); ok {
+		return entry
+	}
+
+	return logrus.NewEntry(logger)
+}
+
+// errorLogger logs every line as an error, for packages which only know Println.
+type errorLogger struct {
+	*logrus.Entry
+}
+
+// Println logs the given values as an error.
+func (l errorLogger) Println(v ...interface{}) {
+	l.Errorln(v...)
+}
+
+// requestIDHeader carries the ID of a request, both ways. Proxies in front of this server may set it, so their logs
+// and ours can be matched; otherwise, a new ID is generated.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern is what request IDs coming from outside must look like, so they can't mangle the logs.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:/+=@-]{1,128}$`)
+
+// requestID returns the ID given in the request, if it looks fine, or a new one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); requestIDPattern.MatchString(id) {
+		return id
+	}
+
+	return randomID()[:16]
+}
+
+// withRequestLogging gives every request an ID, which is sent back in X-Request-ID, and a logger tagged with it, with
+// the provider whose endpoint in mux was requested, if any, and with the ID of the request's trace, if it's traced.
+// Handlers and whatever they call get that logger with logFrom(r.Context()). Once h is done, a line with the request's
+// method, path, status, bytes written and duration is logged: as an error if the status is 5xx, a warning if 4xx, and
+// info otherwise.
+func withRequestLogging(registry *app.Registry, mux *http.ServeMux, h http.Handler) http.Handler {
+	providers := map[string]string{} // by route
+	for _, p := range registry.Providers() {
+		for _, endpoint := range app.Endpoints(p) {
+			providers[endpoint] = p.Name()
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r)
+		w.Header().Set(requestIDHeader, id)
+
+		entry := logrus.NewEntry(logger).WithField("request_id", id)
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			entry = entry.WithField("trace_id", sc.TraceID().String())
+		}
+
+		if _, route := mux.Handler(r); providers[route] != "" {
+			entry = entry.WithField("provider", providers[route])
+		}
+
+		start := time.Now()
+		lw := &statusResponseLogger{w: w, status: http.StatusOK}
+
+		h.ServeHTTP(lw, r.WithContext(app.WithLogger(r.Context(), entry)))
+
+		if r.URL.Path == "/metrics" {
+			return // XXX not logging scrapes, which would drown everything else
+		}
+
+		entry = entry.WithFields(logrus.Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      lw.Status(),
+			"bytes":       lw.Bytes(),
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+		})
+
+		switch {
+		case lw.Status() >= 500:
+			entry.Error("Request served")
+		case lw.Status() >= 400:
+			entry.Warn("Request served")
+		default:
+			entry.Info("Request served")
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hanjos/mea-libris/app"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       string
+		accepted bool
+	}{
+		{"UUID", "8b4c1a2e-1f3b-4c6e-9d2a-0e5f6a7b8c9d", true},
+		{"hex", "0123456789abcdef", true},
+		{"with punctuation", "req_1.2:3/4+5=6@lb", true},
+		{"longest", strings.Repeat("a", 128), true},
+		{"too long", strings.Repeat("a", 129), false},
+		{"empty", "", false},
+		{"spaces", "a b", false},
+		{"quotes", `a"b`, false},
+		{"newline", "a\nlevel=error msg=forged", false},
+		{"non-ASCII", "ação", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if test.id != "" {
+				r.Header.Set(requestIDHeader, test.id)
+			}
+
+			id := requestID(r)
+			if test.accepted && id != test.id {
+				t.Errorf("got %q, want the one given", id)
+			} else if !test.accepted && (id == test.id || !requestIDPattern.MatchString(id)) {
+				t.Errorf("got %q, want a new one", id)
+			}
+		})
+	}
+}
+
+func TestWithRequestLogging(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(logFrom(r.Context()).Data["request_id"].(string)))
+	})
+	h := withRequestLogging(app.NewRegistry(), mux, mux)
+
+	for _, given := range []string{"from-the-proxy", "not\tfine"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(requestIDHeader, given)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		id := w.Header().Get(requestIDHeader)
+		if id == "" {
+			t.Errorf("%q: no request ID sent back", given)
+		} else if (given == "from-the-proxy") != (id == given) {
+			t.Errorf("%q: sent back %q", given, id)
+		}
+
+		if w.Body.String() != id {
+			t.Errorf("%q: the handler's logger has the request ID %q, but %q was sent back", given, w.Body.String(), id)
+		}
+	}
+}
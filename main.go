@@ -1,29 +1,185 @@
 /*
-mea-libris starts a web server which shows your books. Right now, Google Books is the only service supported.
+mea-libris starts a web server which shows your books. Right now, Google Books, Open Library, Calibre libraries and
+folders of EPUB and PDF files are supported, and Goodreads and StoryGraph CSV exports can be imported.
 
-It needs 2 environment variables to function: GOOGLE_CLIENT_ID and GOOGLE_CLIENT_SECRET, which are this app's Google
-credentials. They are necessary to reach your Google books via OAuth.
+Usage:
 
-mea-libris will use other 2 environment variables if available:
+	mea-libris [flags]
+	mea-libris config check [flags]
 
-	PORT: the port which this server will listen to. Defaults to 8080.
+The first form runs the server; the second prints the effective configuration, with secrets masked, and checks it.
 
-	GOOGLE_REDIRECT_URL: the URL Google's OAuth server will respond to, as part of
-	  the OAuth authorization flow. Defaults to
-	  (request.URL.Scheme || http)://(request.Host)/google/oauth2callback.
+Every setting can be given as a command-line flag, an environment variable or an entry in a JSON config file (keyed by
+flag name), whose path is given by -config or CONFIG_FILE. Flags win over environment variables, which win over the
+config file. The configuration is validated at startup, and mea-libris refuses to start if something's wrong.
+
+Two settings are required: -google-client-id (GOOGLE_CLIENT_ID) and -google-client-secret (GOOGLE_CLIENT_SECRET), which
+are this app's Google credentials. They are necessary to reach your Google books via OAuth. The others are:
+
+	-port (PORT): the port which this server will listen to. Defaults to 8080.
+
+	-session-key (SESSION_KEY): a secret, of at least 32 characters, which
+	  session cookies are signed and encrypted with. Should be set: if
+	  empty, a random one is used, so sessions are lost on restart and
+	  can't be shared between instances.
+
+	-google-redirect-url (GOOGLE_REDIRECT_URL): the URL Google's OAuth server
+	  will respond to, as part of the OAuth authorization flow. Defaults to
+	  (scheme)://(host)(prefix)/google/oauth2callback, as the client sees
+	  them; see -trusted-proxies.
+
+	-trusted-proxies (TRUSTED_PROXIES): a comma-separated list of IP addresses
+	  and CIDR networks of reverse proxies, whose Forwarded or
+	  X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix headers are
+	  believed when building redirect URLs. * trusts everyone. Empty, the
+	  default, trusts no one.
+
+	-google-page-workers (GOOGLE_PAGE_WORKERS): how many pages of the user's
+	  books will be fetched from Google at the same time. Defaults to 4.
+
+	-google-max-retries (GOOGLE_MAX_RETRIES): how many times a call to Google
+	  which failed with a transient error (429 or 5xx) will be retried.
+	  Defaults to 3.
+
+	-google-qps (GOOGLE_QPS): the maximum number of calls per second to
+	  Google, counting retries. 0 means no limit. Defaults to 10.
+
+	-google-cache-ttl (GOOGLE_CACHE_TTL): how long a user's books are kept in
+	  memory before being fetched again, as a Go duration (e.g. 90s). 0
+	  disables the cache. Defaults to 5m.
+
+	-google-call-timeout (GOOGLE_CALL_TIMEOUT): how long a single call to
+	  Google (retries included) may take. Defaults to 10s.
+
+	-request-timeout (REQUEST_TIMEOUT): how long a request to this server may
+	  take. 0 means no limit. Defaults to 30s.
+
+	-read-timeout, -write-timeout and -idle-timeout (READ_TIMEOUT,
+	  WRITE_TIMEOUT and IDLE_TIMEOUT): the server's timeouts for reading a
+	  request, writing a response and keeping an idle connection. Default to
+	  10s, 60s and 120s.
+
+	-shutdown-timeout (SHUTDOWN_TIMEOUT): how long the server waits for
+	  in-flight requests after a SIGINT or SIGTERM. Defaults to 30s.
+
+	-tls-cert-file and -tls-key-file (TLS_CERT_FILE and TLS_KEY_FILE): a
+	  certificate and its private key. If given, the server speaks HTTPS.
+
+	-openlibrary-url (OPENLIBRARY_URL): where Open Library's API lives.
+	  Empty disables the Open Library provider. Defaults to
+	  https://openlibrary.org.
+
+	-openlibrary-max-retries and -openlibrary-timeout
+	  (OPENLIBRARY_MAX_RETRIES and OPENLIBRARY_TIMEOUT): how many times a
+	  call to Open Library which failed with a transient error will be
+	  retried, and how long a single call, retries included, may take. 0
+	  means no limit. Default to 3 and 10s.
+
+	-import-dir (IMPORT_DIR): where imported books are kept, one JSON file
+	  per user. If empty, they're kept in memory, and lost on restart.
+
+	-calibre-library (CALIBRE_LIBRARY): a Calibre library's directory, or its
+	  metadata.db, to be served read-only. Empty disables the Calibre
+	  provider, which is the default.
+
+	-books-dir (BOOKS_DIR): a directory to be scanned, subdirectories
+	  included, for EPUB and PDF files. Empty disables the folder
+	  provider, which is the default.
+
+	-snapshots-kept (SNAPSHOTS_KEPT): how many snapshots of each account's
+	  Google books are kept, for /google/changes to tell what changed since
+	  any of them. 0 disables it. Defaults to 20.
+
+	-snapshot-dir (SNAPSHOT_DIR): where snapshots are kept, one JSON file
+	  per user. If empty, they're kept in memory, and lost on restart.
+
+	-snapshot-interval (SNAPSHOT_INTERVAL): how often a snapshot of the
+	  Google books of every account connected to Google is taken, besides
+	  whenever they're fetched. 0 takes them only then. Defaults to 1h.
+
+	-accounts-file (ACCOUNTS_FILE): a JSON file where accounts, and the
+	  providers they're connected to, are kept. If empty, they're kept in
+	  memory, and lost on restart.
+
+	-allow-signup (ALLOW_SIGNUP): whether anyone may create an account with
+	  a password, through /account/signup. Defaults to true.
+
+	-oidc-issuer, -oidc-client-id and -oidc-client-secret (OIDC_ISSUER,
+	  OIDC_CLIENT_ID and OIDC_CLIENT_SECRET): an OpenID Connect issuer, and
+	  this app's credentials with it, to log in through. Empty disables OIDC
+	  login, which is the default.
+
+	-export-target (EXPORT_TARGET): where the Google books of every account
+	  connected to Google are periodically exported to: a directory, a
+	  webdav:// or webdavs:// URL, or an s3://bucket/prefix URL. Empty
+	  disables exports, which is the default.
+
+	-export-formats (EXPORT_FORMATS): the comma-separated formats to export
+	  in. Defaults to csv,json.
+
+	-export-interval (EXPORT_INTERVAL): how often books are exported.
+	  Defaults to 24h.
+
+	-export-keep (EXPORT_KEEP): how many exports of each format are kept
+	  per account. Defaults to 7.
+
+	-export-key and -export-secret (EXPORT_KEY and EXPORT_SECRET): the
+	  WebDAV username and password, or the S3 access key ID and secret key.
+
+	-export-s3-endpoint and -export-s3-region (EXPORT_S3_ENDPOINT and
+	  EXPORT_S3_REGION): where the S3 API lives, and the bucket's region.
+	  Default to https://s3.amazonaws.com and us-east-1.
+
+	-webhook-interval (WEBHOOK_INTERVAL): how often the Google books of
+	  accounts with webhooks are checked for changes. 0 disables webhooks.
+	  Defaults to 1h.
+
+	-webhook-max-retries (WEBHOOK_MAX_RETRIES): how many times a failed
+	  webhook delivery is retried. Defaults to 5.
+
+	-webhook-allow-private (WEBHOOK_ALLOW_PRIVATE): whether webhooks may
+	  point to private addresses, like localhost. Defaults to false.
+
+	-metrics (METRICS): whether to expose Prometheus metrics in /metrics.
+	  They're public, so keep /metrics away from the outside (e.g. in the
+	  reverse proxy) before turning them on. Defaults to false.
+
+	-log-format (LOG_FORMAT): how log lines are written, logfmt or json.
+	  Defaults to logfmt.
+
+	-log-level (LOG_LEVEL): the least severe level logged: debug, info,
+	  warn or error. Defaults to info.
+
+	-otlp-endpoint (OTLP_ENDPOINT): the base URL of an OpenTelemetry
+	  collector speaking OTLP over HTTP, like http://localhost:4318, to
+	  export traces to. Empty disables tracing, which is the default.
+
+Users may log into an account, with a password or through OIDC. Logged in, their connections to each provider are kept
+in their account, server-side, instead of in their session cookie. Accounts may also create API tokens, for scripts to
+read their books with an "Authorization: Bearer <token>" header instead of a session, and webhooks, which are sent
+signed JSON payloads whenever their Google books change.
 
 More details at https://github.com/hanjos/mea-libris .
 */
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"encoding/json"
@@ -31,7 +187,8 @@ import (
 	"github.com/gorilla/sessions"
 	"github.com/hanjos/mea-libris/app"
 	"github.com/hanjos/mea-libris/libris"
-	"golang.org/x/net/context"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/books/v1"
@@ -40,28 +197,35 @@ import (
 var (
 	sessionName = "sessionName"
 
-	googleClientID     = os.Getenv("GOOGLE_CLIENT_ID")
-	googleClientSecret = os.Getenv("GOOGLE_CLIENT_SECRET")
-	googleRedirectURL  = os.Getenv("GOOGLE_REDIRECT_URL")
-	port               = defaultTo(os.Getenv("PORT"), "8080")
+	// Loaded and validated in main
+	cfg *Config
+
+	// Signs and encrypts session cookies. Rebuilt in main, with -session-key if given
+	store = newSessionStore(randomID())
+
+	// Shared by every Google client, so the QPS limit holds for the whole server. Built in main
+	googleTransport *app.RetryTransport
+
+	googleCache *app.BookCache
 
-	store = sessions.NewCookieStore([]byte(randomString()))
+	// The latest snapshots of each account's Google books, for /google/changes. Built in main; nil if disabled
+	googleSnapshots app.SnapshotStore
 
-	// No date or time; an external router can consume this log and provide that
-	logOut = log.New(os.Stdout, "[mea-libris] ", 0)
-	logErr = log.New(os.Stderr, "[mea-libris] ", 0)
+	// Whose forwarding headers are believed when building redirect URLs. Parsed in main
+	trustedProxies app.TrustedProxies
+
+	// Where users' accounts, and their connections, are kept. Built in main
+	accounts app.AccountStore = app.NewMemoryAccountStore()
 )
 
 // SERVICES
 type googleProvider struct {
-	app.Service
-	app.Router
-	app.Client
+	*app.OAuthProvider
 }
 
 func newGoogleProvider(clientID, clientSecret string) *googleProvider {
-	return &googleProvider{
-		app.NewService(),
+	goog := &googleProvider{}
+	goog.OAuthProvider = app.NewOAuthProvider("google",
 		app.NewRouter("/google"),
 		app.NewClient(
 			&oauth2.Config{
@@ -70,32 +234,54 @@ func newGoogleProvider(clientID, clientSecret string) *googleProvider {
 				Endpoint:     google.Endpoint,
 				Scopes:       []string{books.BooksScope},
 			}),
+		cookieSessions{},
+		goog.fetchBooks)
+
+	goog.RevokeURL = "https://oauth2.googleapis.com/revoke"
+	goog.RedirectURL = func(r *http.Request) string {
+		return defaultTo(cfg.GoogleRedirectURL, buildRedirectURL(r, goog))
+	}
+	goog.HTTPClient = &http.Client{Transport: googleTransport}
+	goog.Timeout = cfg.GoogleCallTimeout
+	goog.OnDisconnect = func(token *oauth2.Token) {
+		googleCache.Invalidate(cacheUser(token.AccessToken))
 	}
+	goog.Tokens = accountTokens{}
+	goog.OnRefresh = observeTokenRefresh(goog.Name())
+	goog.Log = logger
+
+	return goog
 }
 
-func (goog *googleProvider) HandleBooks(w http.ResponseWriter, r *http.Request) *app.Error {
-	session, err := store.Get(r, sessionName)
-	if err != nil {
-		// TODO ignoring session errors
-		//return app.Wrap(errSessionError(sessionName, err), http.StatusInternalServerError)
+// CheckHealth implements the app.HealthChecker interface, checking that this app's Google credentials are there.
+func (goog *googleProvider) CheckHealth(ctx context.Context) error {
+	if config := goog.Config(); config.ClientID == "" || config.ClientSecret == "" {
+		return errMissingCredentials
 	}
 
-	token, ok := session.Values["accessToken"].(string)
-	if !ok {
-		return app.Wrap(errAccessTokenNotFound, http.StatusUnauthorized)
-	}
+	return nil
+}
 
-	svc, err := newGoogleBooksClient(goog.Config(), context.Background(), token)
+// HandleBooks overrides app.OAuthProvider's, so that clients can make conditional requests against the cache.
+func (goog *googleProvider) HandleBooks(w http.ResponseWriter, r *http.Request) *app.Error {
+	token, err := goog.Token(r)
 	if err != nil {
-		return app.Wrap(err, http.StatusInternalServerError)
+		return app.Wrap(err, http.StatusUnauthorized)
 	}
 
-	bs, err := getGoogleBooks(svc)
+	client, keep := goog.RequestClient(r, token)
+	entry, err := goog.cachedBooks(r, client, token)
+	keep(w)
 	if err != nil {
 		return app.Wrap(err, http.StatusInternalServerError)
 	}
 
-	err = encodeBooks(bs, w, r)
+	if checkNotModified(w, r, entry) {
+		logFrom(r.Context()).Info("The user's books didn't change")
+		return nil
+	}
+
+	err = encodeBooks(entry.Books, w, r)
 	if err != nil {
 		return app.Wrap(err, http.StatusInternalServerError)
 	}
@@ -103,135 +289,287 @@ func (goog *googleProvider) HandleBooks(w http.ResponseWriter, r *http.Request)
 	return nil
 }
 
-func (goog *googleProvider) HandleConnect(w http.ResponseWriter, r *http.Request) *app.Error {
-	session, err := store.Get(r, sessionName)
+// fetchBooks is googleProvider's app.BookFetcher.
+func (goog *googleProvider) fetchBooks(r *http.Request, client *http.Client, token *oauth2.Token) (libris.Books, error) {
+	entry, err := goog.cachedBooks(r, client, token)
 	if err != nil {
-		// TODO ignoring session errors
-		//return app.Wrap(errSessionError(sessionName, err), http.StatusInternalServerError)
+		return nil, err
 	}
 
-	_, ok := session.Values["accessToken"].(string)
-	if ok {
-		logOut.Println("User authenticated and authorized.")
-		fmt.Fprintln(w, "Connected!") // XXX w.WriteHeader(http.StatusOK) is implicit
-		return nil
+	observeBooks(goog.Name(), entry.Books)
+	return entry.Books, nil
+}
+
+// cachedBooks returns the user's books from the cache, fetching them from Google if they aren't there or the client
+// asked for fresh ones.
+func (goog *googleProvider) cachedBooks(r *http.Request, client *http.Client, token *oauth2.Token) (*app.CacheEntry, error) {
+	query, err := parseGoogleBooksQuery(r)
+	if err != nil {
+		return nil, app.Wrap(err, http.StatusBadRequest)
 	}
 
-	logOut.Println("User not authorized; beginning auth exchange")
-	logOut.Println("Generating a new state")
-	state := randomString()
-	session.Values["state"] = state
-	session.Save(r, w)
+	user := cacheUser(token.AccessToken)
+	entry, ok := googleCache.Get(user, query.String())
+	switch {
+	case ok && !noCache(r):
+		googleCacheLookups.WithLabelValues("hit").Inc()
+		logFrom(r.Context()).Info("Using the cached books")
+		return entry, nil
+	case ok:
+		googleCacheLookups.WithLabelValues("bypass").Inc()
+	default:
+		googleCacheLookups.WithLabelValues("miss").Inc()
+	}
 
-	redirectURL := defaultTo(googleRedirectURL, buildRedirectURL(r, goog))
-	logOut.Printf("Setting the redirect URL to %s\n", redirectURL)
-	config := goog.Config()
-	config.RedirectURL = redirectURL
+	svc, err := newGoogleBooksClient(client)
+	if err != nil {
+		return nil, app.Wrap(err, http.StatusInternalServerError)
+	}
 
-	logOut.Println("Redirecting to Google's OAuth servers for a code")
-	url := config.AuthCodeURL(state)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
-	return nil
+	bs, err := getGoogleBooks(r.Context(), svc, query)
+	if err != nil {
+		return nil, app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	if a, ok := currentAccount(r); ok && googleSnapshots != nil {
+		if _, err := googleSnapshots.Record(snapshotUser(a, query), bs); err != nil {
+			logFrom(r.Context()).Error(errCantRecordSnapshot(err))
+		}
+	}
+
+	return googleCache.Put(user, query.String(), bs), nil
 }
 
-func (goog *googleProvider) HandleDisconnect(w http.ResponseWriter, r *http.Request) *app.Error {
-	session, err := store.Get(r, sessionName)
-	if err != nil {
-		// TODO ignoring session errors
-		//return app.Wrap(errSessionError(sessionName, err), http.StatusInternalServerError)
+// Changes implements the app.ChangeFeed interface, returning "/google/changes".
+func (goog *googleProvider) Changes() string {
+	return goog.Route("/changes")
+}
+
+// HandleChanges implements the app.ChangeFeed interface. It sends what changed in the user's books from the snapshot
+// given in the since query parameter, either by ID or as an RFC 3339 time, to the latest one. Without since, every
+// book is sent as added. Books are told apart by volume ID. Snapshots are kept by account, so users must be logged
+// into one.
+func (goog *googleProvider) HandleChanges(w http.ResponseWriter, r *http.Request) *app.Error {
+	if googleSnapshots == nil {
+		return app.Wrap(errChangesDisabled, http.StatusNotFound)
 	}
 
-	token, ok := session.Values["accessToken"].(string)
+	a, ok := currentAccount(r)
 	if !ok {
-		logOut.Println("User wasn't connected. Nothing was done.")
-		fmt.Fprintln(w, "User wasn't connected. Nothing was done.")
+		return app.Wrap(errChangesNeedAccount, http.StatusUnauthorized)
+	}
+
+	token, err := goog.Token(r)
+	if err != nil {
+		return app.Wrap(err, http.StatusUnauthorized)
+	}
+
+	client, keep := goog.RequestClient(r, token)
+	entry, err := goog.cachedBooks(r, client, token)
+	keep(w)
+	if err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	query, _ := parseGoogleBooksQuery(r) // XXX already checked by cachedBooks
+	user := snapshotUser(a, query)
+
+	// XXX the books may come from the cache, and have been fetched before snapshots were taken
+	latest, err := googleSnapshots.Record(user, entry.Books)
+	if err != nil {
+		return app.Wrap(errCantRecordSnapshot(err), http.StatusInternalServerError)
+	}
+
+	old, sinceID := libris.Books{}, ""
+	if since := r.URL.Query().Get("since"); since != "" {
+		var snapshot *app.Snapshot
+		var ok bool
+		if t, parseErr := time.Parse(time.RFC3339, since); parseErr == nil {
+			snapshot, ok, err = googleSnapshots.At(user, t)
+		} else {
+			snapshot, ok, err = googleSnapshots.Get(user, since)
+		}
+
+		if err != nil {
+			return app.Wrap(errCantLoadSnapshot(err), http.StatusInternalServerError)
+		} else if !ok {
+			return app.Wrap(errSnapshotNotFound(since), http.StatusGone)
+		}
+
+		old, sinceID = snapshot.Books, snapshot.ID
+	}
+
+	logFrom(r.Context()).Infof("Diffing the user's books from snapshot %q to %s", sinceID, latest.ID)
+	changes := libris.Diff(old, latest.Books, googleVolumeID)
+
+	w.Header().Set("X-Snapshot", latest.ID)
+	if bookFormat(r) == "csv" {
+		w.Header().Set("Content-Type", "text/csv;charset=utf-8")
+		if err := changes.EncodeCSV(w); err != nil {
+			return app.Wrap(errCantEncodeBooks(err), http.StatusInternalServerError)
+		}
+
 		return nil
 	}
 
-	logOut.Println("Disconnecting the current user")
-	url := "https://accounts.google.com/o/oauth2/revoke?token=" + token
-	resp, err := http.Get(url)
-	defer resp.Body.Close()
+	return writeJSON(w, http.StatusOK, struct {
+		Since    string    `json:"since,omitempty"`
+		Snapshot string    `json:"snapshot"`
+		Taken    time.Time `json:"taken"`
+		*libris.Changes
+	}{sinceID, latest.ID, latest.Taken, changes})
+}
+
+// snapshotUser identifies the account's snapshots of the books matching query. Users who aren't logged in have
+// nothing as stable as an account ID to go by, since their tokens change, so they have no snapshots.
+func snapshotUser(a *app.Account, query *googleBooksQuery) string {
+	return "account " + a.ID + " " + query.String()
+}
+
+// accountBooks fetches the Google books of the given account, as listed by default, for background jobs, which have
+// no request to go by. A token refreshed along the way is kept in the account.
+func (goog *googleProvider) accountBooks(ctx context.Context, a *app.Account) (libris.Books, error) {
+	var token oauth2.Token
+	if err := json.Unmarshal([]byte(a.Connections[goog.Name()]), &token); err != nil {
+		return nil, err
+	}
+
+	svc, err := newGoogleBooksClient(goog.AuthClient(ctx, &token, func(token *oauth2.Token) {
+		if err := goog.keepAccountToken(a.ID, token); err != nil {
+			logFrom(ctx).Error(errCantSaveAccount(err))
+		}
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	return getGoogleBooks(ctx, svc, defaultGoogleBooksQuery())
+}
+
+// keepAccountToken replaces the Google token kept in the given account with a refreshed one, unless the account was
+// disconnected from Google in the meantime.
+func (goog *googleProvider) keepAccountToken(accountID string, token *oauth2.Token) error {
+	tokenJSON, err := json.Marshal(token)
 	if err != nil {
-		return app.Wrap(errCantRevokeToken(err), http.StatusInternalServerError)
+		return err
 	}
 
-	logOut.Println("Resetting the session")
-	session.Values["state"] = nil
-	session.Values["accessToken"] = nil
-	session.Save(r, w)
+	_, err = accounts.Update(accountID, func(a *app.Account) {
+		if a.Connections[goog.Name()] != "" {
+			a.Connections[goog.Name()] = string(tokenJSON)
+		}
+	})
 
-	fmt.Fprintln(w, "User disconnected!")
-	return nil
+	return err
 }
 
-func (goog *googleProvider) HandleOAuthCallback(w http.ResponseWriter, r *http.Request) *app.Error {
-	logOut.Println("Validating the state")
+// googleVolumeID returns the Google Books volume ID of b, if it came from Google.
+func googleVolumeID(b *libris.Book) string {
+	return b.Identifiers["google"]
+}
+
+// minSessionKeyLength is the least number of characters -session-key must have.
+const minSessionKeyLength = 32
+
+// newSessionStore creates a cookie store whose cookies are signed with HMAC-SHA256 and encrypted with AES-256, since
+// they may carry OAuth tokens. Both keys are derived from the given secret. The cookies are kept from scripts and from
+// cross-site requests other than top-level navigation.
+func newSessionStore(secret string) *sessions.CookieStore {
+	key := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(purpose))
+		return mac.Sum(nil)
+	}
+
+	s := sessions.NewCookieStore(key("session authentication"), key("session encryption"))
+	s.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   86400 * 30,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	return s
+}
+
+// cookieSessions implements app.Sessions on top of the cookie store.
+type cookieSessions struct{}
 
+// Value implements the app.Sessions interface.
+func (cookieSessions) Value(r *http.Request, key string) string {
 	session, err := store.Get(r, sessionName)
 	if err != nil {
 		// TODO ignoring session errors
-		//return app.Wrap(errSessionError(sessionName, err), http.StatusInternalServerError)
+		//return ""
 	}
 
-	sessionState, ok := session.Values["state"].(string)
-
-	// XXX state is a one-time value; we won't need it after this function
-	defer func() {
-		session.Values["state"] = nil
-	}()
+	value, _ := session.Values[key].(string)
+	return value
+}
 
-	if !ok || r.FormValue("state") != sessionState {
-		return app.Wrap(errInvalidState(sessionState, r.FormValue("state")), http.StatusBadRequest)
+// Save implements the app.Sessions interface.
+func (cookieSessions) Save(w http.ResponseWriter, r *http.Request, values map[string]string) error {
+	session, err := store.Get(r, sessionName)
+	if err != nil {
+		// TODO ignoring session errors
+		//return errSessionError(sessionName, err)
 	}
 
-	logOut.Println("Checking for errors")
-	if errMsg := r.FormValue("error"); errMsg != "" {
-		return app.Wrap(errCallbackError(errMsg), http.StatusUnauthorized)
+	for key, value := range values {
+		if value == "" {
+			delete(session.Values, key)
+		} else {
+			session.Values[key] = value
+		}
 	}
 
-	logOut.Println("Reading the code")
-	code := r.FormValue("code")
-	if code == "" {
-		return app.Wrap(errCodeNotFound, http.StatusBadRequest)
-	}
+	return saveSession(w, r, session)
+}
 
-	logOut.Println("Exchanging the code for an access token")
-	config := goog.Config()
-	token, err := config.Exchange(context.Background(), code)
+// Renew replaces everything in the session with the given values, so nothing from before, like a CSRF token, survives.
+func (cookieSessions) Renew(w http.ResponseWriter, r *http.Request, values map[string]string) error {
+	session, err := store.Get(r, sessionName)
 	if err != nil {
-		return app.Wrap(errTokenExchangeError(err), http.StatusInternalServerError)
+		// TODO ignoring session errors
+		//return errSessionError(sessionName, err)
 	}
 
-	session.Values["accessToken"] = token.AccessToken // XXX can't store a *oauth2.Token, so we store a string
-	session.Save(r, w)
+	session.Values = map[interface{}]interface{}{}
+	for key, value := range values {
+		if value != "" {
+			session.Values[key] = value
+		}
+	}
 
-	connectEndpoint := goog.Route("/connect")
-	logOut.Printf("Redirecting to %v to finish the auth process\n", connectEndpoint)
-	http.Redirect(w, r, connectEndpoint, http.StatusTemporaryRedirect)
-	return nil
+	return saveSession(w, r, session)
+}
+
+// saveSession writes the session's cookie, marked Secure if the client reached this server over HTTPS, directly or
+// through a trusted proxy.
+func saveSession(w http.ResponseWriter, r *http.Request, session *sessions.Session) error {
+	scheme, _, _ := trustedProxies.Origin(r)
+	session.Options.Secure = scheme == "https"
+
+	return session.Save(r, w)
 }
 
 // STEP FUNCTIONS
 
 // buildRedirectURL builds a prospective redirect URL, given a request and an app.Router. The validity of this URL
-// depends on how the server is deployed, but this function presents a best-effort attempt to automatically detect it.
+// depends on how the server is deployed, but this function presents a best-effort attempt to automatically detect it:
+// behind trusted reverse proxies, the scheme, host and path prefix they forward are used.
 func buildRedirectURL(r *http.Request, router app.Router) string {
-	scheme := r.URL.Scheme // use 'http' if this is empty
-	if scheme == "" {
-		scheme = "http"
-	}
-
-	return scheme + "://" + r.Host + router.OAuthCallback()
+	return originURL(r) + router.OAuthCallback()
 }
 
-func newGoogleBooksClient(config *oauth2.Config, ctx context.Context, token string) (*books.Service, error) {
-	logOut.Println("Using the access token to build a Google Books client")
+// originURL returns the scheme, host and path prefix the client used to reach this server, as an URL.
+func originURL(r *http.Request) string {
+	scheme, host, prefix := trustedProxies.Origin(r)
 
-	tok := new(oauth2.Token)
-	tok.AccessToken = token
+	return scheme + "://" + host + prefix
+}
 
-	client := config.Client(ctx, tok)
+func newGoogleBooksClient(client *http.Client) (*books.Service, error) {
 	svc, err := books.New(client)
 	if err != nil {
 		return nil, errCantLoadBooksClient(err)
@@ -240,37 +578,227 @@ func newGoogleBooksClient(config *oauth2.Config, ctx context.Context, token stri
 	return svc, nil
 }
 
-func getGoogleBooks(svc *books.Service) ([]*libris.Book, error) {
-	logOut.Print("Getting the user's books")
+// googleBooksQuery holds the filters used when listing the user's volumes.
+type googleBooksQuery struct {
+	AcquireMethods   []string
+	ProcessingStates []string
+}
 
-	myBooks := []*libris.Book{}
-	nextIndex, totalItems := int64(0), int64(0)
-	for {
-		volumes, err := svc.Volumes.Mybooks.List().
-			StartIndex(nextIndex).
-			AcquireMethod("FAMILY_SHARED", "PREORDERED", "PUBLIC_DOMAIN", "PURCHASED", "RENTED", "SAMPLE", "UPLOADED").
-			ProcessingState("COMPLETED_SUCCESS").
-			Do()
-		if err != nil {
-			return nil, errCantLoadVolumes(err)
+var (
+	googleAcquireMethods   = []string{"FAMILY_SHARED", "PREORDERED", "PUBLIC_DOMAIN", "PURCHASED", "RENTED", "SAMPLE", "UPLOADED"}
+	googleProcessingStates = []string{"COMPLETED_FAILED", "COMPLETED_SUCCESS", "RUNNING"}
+
+	// what's listed when no processing state is asked for
+	googleDefaultProcessingStates = []string{"COMPLETED_SUCCESS"}
+)
+
+// parseGoogleBooksQuery reads the acquireMethod and processingState query parameters from the request. Both may be
+// repeated or hold comma-separated values. If absent, every acquire method and only successfully processed uploads
+// are included.
+func parseGoogleBooksQuery(r *http.Request) (*googleBooksQuery, error) {
+	acquireMethods, err := queryValues(r, "acquireMethod", googleAcquireMethods)
+	if err != nil {
+		return nil, err
+	}
+
+	processingStates, err := queryValues(r, "processingState", googleProcessingStates)
+	if err != nil {
+		return nil, err
+	}
+
+	return &googleBooksQuery{
+		AcquireMethods:   defaultToSlice(acquireMethods, googleAcquireMethods),
+		ProcessingStates: defaultToSlice(processingStates, googleDefaultProcessingStates),
+	}, nil
+}
+
+// defaultGoogleBooksQuery returns the query of a request without query parameters.
+func defaultGoogleBooksQuery() *googleBooksQuery {
+	return &googleBooksQuery{
+		AcquireMethods:   googleAcquireMethods,
+		ProcessingStates: googleDefaultProcessingStates,
+	}
+}
+
+// String returns a representation of the query, which identifies its results in the cache.
+func (q *googleBooksQuery) String() string {
+	return strings.Join(q.AcquireMethods, ",") + ";" + strings.Join(q.ProcessingStates, ",")
+}
+
+// queryValues returns the values of the given query parameter, validated (case-insensitively) against the allowed
+// ones.
+func queryValues(r *http.Request, param string, allowed []string) ([]string, error) {
+	return splitValues(param, r.URL.Query()[param], allowed)
+}
+
+// splitValues splits the given parameter's raw values, which may be comma-separated, and validates them
+// (case-insensitively) against the allowed ones.
+func splitValues(param string, raw []string, allowed []string) ([]string, error) {
+	var values []string
+	for _, v := range raw {
+		for _, value := range strings.Split(v, ",") {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+
+			canonical, ok := lookupFold(allowed, value)
+			if !ok {
+				return nil, errInvalidQueryValue(param, value, allowed)
+			}
+
+			values = append(values, canonical)
 		}
+	}
+
+	return values, nil
+}
 
-		for _, v := range volumes.Items {
-			myBooks = append(myBooks, newBook(v))
+// googleMaxResults is the largest page size the Books API accepts.
+const googleMaxResults = 40
+
+// getGoogleBooks lists the user's books. The first page tells how many volumes there are, so the remaining pages are
+// fetched concurrently, by at most cfg.GooglePageWorkers goroutines. Should any page fail or ctx be cancelled (e.g. the
+// client hung up), the pending pages are abandoned.
+func getGoogleBooks(ctx context.Context, svc *books.Service, query *googleBooksQuery) (_ []*libris.Book, err error) {
+	ctx, span := startSpan(ctx, "getGoogleBooks",
+		attribute.StringSlice("google.acquire_methods", query.AcquireMethods),
+		attribute.StringSlice("google.processing_states", query.ProcessingStates))
+	defer func() { endSpan(span, err) }()
+
+	logFrom(ctx).Infof("Getting the user's books (acquire methods: %v; processing states: %v)",
+		query.AcquireMethods, query.ProcessingStates)
+
+	first, err := listGoogleVolumes(ctx, svc, query, 0, googleMaxResults)
+	if err != nil {
+		return nil, err
+	}
+
+	totalItems := first.TotalItems
+	pages := [][]*books.Volume{first.Items}
+	if int64(len(first.Items)) < totalItems {
+		rest, err := listRemainingGoogleVolumes(ctx, svc, query, int64(len(first.Items)), totalItems)
+		if err != nil {
+			return nil, err
 		}
 
-		nextIndex, totalItems = nextIndex+int64(len(volumes.Items)), volumes.TotalItems
-		if nextIndex >= totalItems {
-			// XXX since there's no do-while, here we 'go'
-			break
+		pages = append(pages, rest...)
+	}
+
+	myBooks := []*libris.Book{}
+	for _, page := range pages {
+		for _, v := range page {
+			myBooks = append(myBooks, newBook(v, query))
 		}
 	}
 
-	logOut.Printf("%d books processed (of a total of %d)\n", len(myBooks), totalItems)
+	if int64(len(myBooks)) != totalItems {
+		logFrom(ctx).Warnf("Google said there were %d books, but sent %d", totalItems, len(myBooks))
+	}
+
+	googlePages.Observe(float64(len(pages)))
+	span.SetAttributes(attribute.Int("google.pages", len(pages)), attribute.Int("books", len(myBooks)))
+	logFrom(ctx).Infof("%d books processed in %d pages (of a total of %d)", len(myBooks), len(pages), totalItems)
 	return myBooks, nil
 }
 
-func newBook(v *books.Volume) *libris.Book {
+// listRemainingGoogleVolumes fetches every page from startIndex up to totalItems concurrently, returning them in
+// order. Google may send fewer volumes than asked for, so each page is fetched until full, or until Google has no more
+// volumes there. The error returned is the first failure, rather than the cancellations which followed it.
+func listRemainingGoogleVolumes(ctx context.Context, svc *books.Service, query *googleBooksQuery, startIndex, totalItems int64) ([][]*books.Volume, error) {
+	var indexes []int64
+	for i := startIndex; i < totalItems; i += googleMaxResults {
+		indexes = append(indexes, i)
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if firstErr == nil {
+			firstErr = err
+			cancel() // no point in getting the other pages
+		}
+	}
+
+	pages := make([][]*books.Volume, len(indexes))
+	workers := make(chan struct{}, cfg.GooglePageWorkers)
+
+	var wg sync.WaitGroup
+	for i, index := range indexes {
+		wg.Add(1)
+		go func(i int, index int64) {
+			defer wg.Done()
+
+			select {
+			case workers <- struct{}{}:
+				defer func() { <-workers }()
+			case <-ctx.Done():
+				return
+			}
+
+			end := index + googleMaxResults
+			if end > totalItems {
+				end = totalItems
+			}
+
+			for next := index; next < end; {
+				volumes, err := listGoogleVolumes(ctx, svc, query, next, end-next)
+				if err != nil {
+					fail(err)
+					return
+				} else if len(volumes.Items) == 0 {
+					break
+				}
+
+				pages[i] = append(pages[i], volumes.Items...)
+				next += int64(len(volumes.Items))
+			}
+		}(i, index)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	} else if err := parent.Err(); err != nil {
+		return nil, errCantLoadVolumes(err)
+	}
+
+	return pages, nil
+}
+
+// listGoogleVolumes fetches a single page of at most maxResults of the user's volumes, starting at startIndex. Gives up
+// after cfg.GoogleCallTimeout, retries included.
+func listGoogleVolumes(ctx context.Context, svc *books.Service, query *googleBooksQuery, startIndex, maxResults int64) (_ *books.Volumes, err error) {
+	ctx, span := startSpan(ctx, "Mybooks.List", attribute.Int64("google.start_index", startIndex),
+		attribute.Int64("google.max_results", maxResults))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.GoogleCallTimeout)
+	defer cancel()
+
+	volumes, err := svc.Volumes.Mybooks.List().
+		StartIndex(startIndex).
+		MaxResults(maxResults).
+		AcquireMethod(query.AcquireMethods...).
+		ProcessingState(query.ProcessingStates...).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, errCantLoadVolumes(err)
+	}
+
+	span.SetAttributes(attribute.Int("google.items", len(volumes.Items)))
+	return volumes, nil
+}
+
+func newBook(v *books.Volume, query *googleBooksQuery) *libris.Book {
 	info := v.VolumeInfo
 
 	// resolving the identification
@@ -295,32 +823,133 @@ func newBook(v *books.Volume) *libris.Book {
 	}
 
 	// removing the extension from the title if it's there
-	title := info.Title
-	if strings.HasSuffix(strings.ToLower(title), ".pdf") && fileType == "PDF" {
-		title = title[:len(title)-4]
-	} else if strings.HasSuffix(strings.ToLower(title), ".epub") && fileType == "EPUB" {
-		title = title[:len(title)-5]
+	title := trimExtension(info.Title, fileType)
+
+	book := &libris.Book{
+		Title:             title,
+		Authors:           info.Authors,
+		Identifier:        id,
+		IdentifierType:    idType,
+		AverageRating:     info.AverageRating,
+		Publisher:         info.Publisher,
+		FileType:          fileType,
+		AcquisitionMethod: acquisitionMethod(v.UserInfo, query),
 	}
 
-	return &libris.Book{
-		Title:          title,
-		Authors:        info.Authors,
-		Identifier:     id,
-		IdentifierType: idType,
-		AverageRating:  info.AverageRating,
-		Publisher:      info.Publisher,
-		FileType:       fileType,
+	if v.Id != "" {
+		book.Identifiers = map[string]string{"google": v.Id}
 	}
+
+	// the user-specific bits
+	if userInfo := v.UserInfo; userInfo != nil {
+		if userInfo.UserUploadedVolumeInfo != nil {
+			book.ProcessingState = userInfo.UserUploadedVolumeInfo.ProcessingState
+		}
+
+		book.RentalState = userInfo.RentalState
+		if userInfo.RentalPeriod != nil {
+			if sec, err := strconv.ParseInt(userInfo.RentalPeriod.EndUtcSec, 10, 64); err == nil {
+				expiry := time.Unix(sec, 0).UTC()
+				book.RentalExpiry = &expiry
+			}
+		}
+	}
+
+	return book
 }
 
-func encodeBooks(books []*libris.Book, w io.Writer, r *http.Request) error {
-	logOut.Printf("Requested response format: %s\n", r.Header.Get("Accept"))
+// trimExtension removes the extension matching fileType (e.g. .pdf for PDF) from title, if it's there. Uploaded
+// files tend to be titled after their file names.
+func trimExtension(title, fileType string) string {
+	ext := "." + strings.ToLower(fileType)
+	if fileType != "UNKNOWN" && strings.HasSuffix(strings.ToLower(title), ext) {
+		return title[:len(title)-len(ext)]
+	}
+
+	return title
+}
+
+// acquisitionMethod figures out how the user acquired a volume. Google doesn't say which acquire method matched, so
+// this is a best-effort attempt: if only one method was asked for, that's the answer; otherwise, the user info flags
+// are checked. Samples and public domain volumes have no such flags, so they end up as UNKNOWN.
+func acquisitionMethod(userInfo *books.VolumeUserInfo, query *googleBooksQuery) string {
+	if len(query.AcquireMethods) == 1 {
+		return query.AcquireMethods[0]
+	}
+
+	switch {
+	case userInfo == nil:
+		return "UNKNOWN"
+	case userInfo.IsUploaded:
+		return "UPLOADED"
+	case userInfo.RentalState != "":
+		return "RENTED"
+	case userInfo.IsPreordered:
+		return "PREORDERED"
+	case userInfo.IsFamilySharedToUser:
+		return "FAMILY_SHARED"
+	case userInfo.IsPurchased:
+		return "PURCHASED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// noCache returns true if the request demands fresh data, via Cache-Control or Pragma.
+func noCache(r *http.Request) bool {
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+			return true
+		}
+	}
+
+	return strings.EqualFold(r.Header.Get("Pragma"), "no-cache")
+}
+
+// checkNotModified sets the cache validators for entry in the response, and answers 304 Not Modified if the request's
+// If-None-Match or If-Modified-Since headers show the client already has it. Returns true if it did. The ETag depends
+// on the format the books are sent in, since JSON and CSV are different representations of them.
+func checkNotModified(w http.ResponseWriter, r *http.Request, entry *app.CacheEntry) bool {
+	etag := strings.TrimSuffix(entry.ETag, `"`) + "-" + bookFormat(r) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", entry.LastModified.Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Vary", "Accept, Cookie, Authorization")
+
+	notModified := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		// XXX If-None-Match takes precedence over If-Modified-Since
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				notModified = true
+				break
+			}
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		notModified = !entry.LastModified.After(ims)
+	}
+
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+	}
+
+	return notModified
+}
+
+func encodeBooks(books []*libris.Book, w io.Writer, r *http.Request) (err error) {
+	logFrom(r.Context()).Debugf("Requested response format: %s", r.Header.Get("Accept"))
 
 	contentType := httputil.NegotiateContentType(r,
 		[]string{"application/json", "text/csv", "application/csv"},
 		"application/json")
 
-	logOut.Printf("Negotiated content type: %s\n", contentType)
+	logFrom(r.Context()).Debugf("Negotiated content type: %s", contentType)
+	_, span := startSpan(r.Context(), "encodeBooks", attribute.String("content_type", contentType),
+		attribute.Int("books", len(books)))
+	defer func() { endSpan(span, err) }()
+
 	switch contentType {
 	case "application/json":
 		return encodeBooksAsJSON(books, w)
@@ -329,14 +958,12 @@ func encodeBooks(books []*libris.Book, w io.Writer, r *http.Request) error {
 	case "text/csv":
 		return encodeBooksAsCSV(books, w)
 	default:
-		logOut.Printf("Unexpected content type %s; rendering as application/json", contentType)
+		logFrom(r.Context()).Warnf("Unexpected content type %s; rendering as application/json", contentType)
 		return encodeBooksAsJSON(books, w)
 	}
 }
 
 func encodeBooksAsJSON(books []*libris.Book, w io.Writer) error {
-	logOut.Println("Encoding books as JSON")
-
 	// XXX setting headers has do be done BEFORE writing the body, or it'll be ignored!
 	if rw, ok := w.(http.ResponseWriter); ok {
 		rw.Header().Set("Content-Type", "application/json;charset=utf-8")
@@ -351,8 +978,6 @@ func encodeBooksAsJSON(books []*libris.Book, w io.Writer) error {
 }
 
 func encodeBooksAsCSV(books []*libris.Book, w io.Writer) error {
-	logOut.Println("Encoding books as CSV")
-
 	// XXX setting headers has do be done BEFORE writing the body, or it'll be ignored!
 	if rw, ok := w.(http.ResponseWriter); ok {
 		rw.Header().Set("Content-Type", "text/csv;charset=utf-8")
@@ -368,27 +993,256 @@ func encodeBooksAsCSV(books []*libris.Book, w io.Writer) error {
 
 // MAIN
 func main() {
-	goog := newGoogleProvider(googleClientID, googleClientSecret)
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "config" {
+		os.Exit(configCommand(args[1:]))
+	}
+
+	c, err := loadConfig(args)
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		logger.Error(err)
+		os.Exit(2)
+	}
+
+	if err := c.Validate(); err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	}
+
+	cfg = c
+	configureLogger(cfg.LogFormat, cfg.LogLevel)
+
+	sessionKey := cfg.SessionKey
+	if sessionKey == "" {
+		logger.Warn("No session key given; using a random one. Sessions won't survive a restart, or be shared with " +
+			"other instances. Set -session-key or SESSION_KEY to keep them")
+		sessionKey = randomID()
+	}
+	store = newSessionStore(sessionKey)
+
+	var tp *sdktrace.TracerProvider
+	if cfg.OTLPEndpoint != "" {
+		if tp, err = newTracerProvider(context.Background(), cfg.OTLPEndpoint); err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	googleTransport = app.NewRetryTransport(cfg.GoogleMaxRetries, float64(cfg.GoogleQPS), logger)
+	googleTransport.Base = googleMetricsTransport{tracingTransport(http.DefaultTransport)}
+	googleCache = app.NewBookCache(cfg.GoogleCacheTTL)
+	trustedProxies, _ = app.ParseTrustedProxies(cfg.TrustedProxies) // XXX already checked by Validate
+
+	if cfg.SnapshotsKept > 0 {
+		googleSnapshots = app.NewMemorySnapshotStore(cfg.SnapshotsKept)
+		if cfg.SnapshotDir != "" {
+			if googleSnapshots, err = app.NewFileSnapshotStore(cfg.SnapshotDir, cfg.SnapshotsKept); err != nil {
+				logger.Error(errCantRecordSnapshot(err))
+				os.Exit(1)
+			}
+		}
+	}
+
+	registry := app.NewRegistry()
+	goog := newGoogleProvider(cfg.GoogleClientID, cfg.GoogleClientSecret)
+	if err := registry.Register(goog); err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	}
+
+	if cfg.OpenLibraryURL != "" {
+		transport := app.NewRetryTransport(cfg.OpenLibraryMaxRetries, 0, logger)
+		transport.Base = tracingTransport(http.DefaultTransport)
+
+		client := &http.Client{Transport: transport, Timeout: cfg.OpenLibraryTimeout}
+		if err := registry.Register(newOpenLibraryProvider(cfg.OpenLibraryURL, client)); err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	var importStore app.BookStore = app.NewMemoryBookStore()
+	if cfg.ImportDir != "" {
+		if importStore, err = app.NewFileBookStore(cfg.ImportDir); err != nil {
+			logger.Error(errCantStoreImportedBooks(err))
+			os.Exit(1)
+		}
+	}
+
+	if err := registry.Register(newImportProvider(importStore)); err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	}
+
+	if cfg.CalibreLibrary != "" {
+		cal, err := newCalibreProvider(cfg.CalibreLibrary)
+		if err == nil {
+			err = registry.Register(cal)
+		}
+
+		if err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.BooksDir != "" {
+		if err := registry.Register(newFolderProvider(cfg.BooksDir)); err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.AccountsFile != "" {
+		if accounts, err = app.NewFileAccountStore(cfg.AccountsFile); err != nil {
+			logger.Error(errCantLoadAccount(err))
+			os.Exit(1)
+		}
+	}
+
+	var login *oidcLogin
+	if cfg.OIDCIssuer != "" {
+		client := &http.Client{Timeout: cfg.GoogleCallTimeout}
+		if login, err = newOIDCLogin(context.Background(), cfg.OIDCIssuer, cfg.OIDCClientID, cfg.OIDCClientSecret, client); err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	var exp *exporter
+	if cfg.ExportTarget != "" {
+		// XXX Validate already checked these
+		target, _ := newExportTarget(cfg)
+		formats, _ := splitValues("export-formats", []string{cfg.ExportFormats}, exportFormatNames)
+
+		exp = newExporter(goog, target, formats, cfg.ExportKeep, cfg.ExportInterval, cfg.RequestTimeout)
+	}
+
+	var sender *app.WebhookSender
+	var watcher *webhookWatcher
+	if cfg.WebhookInterval > 0 {
+		// XXX only the latest snapshot is needed, to compare with the next one
+		var snapshots app.SnapshotStore = app.NewMemorySnapshotStore(1)
+		if cfg.SnapshotDir != "" {
+			if snapshots, err = app.NewFileSnapshotStore(cfg.SnapshotDir, 1); err != nil {
+				logger.Error(errCantRecordSnapshot(err))
+				os.Exit(1)
+			}
+		}
+
+		client := app.NewWebhookClient(cfg.GoogleCallTimeout, cfg.WebhookAllowPrivate)
+		sender = app.NewWebhookSender(client, cfg.WebhookMaxRetries, logger)
+		watcher = newWebhookWatcher(goog, sender, snapshots, cfg.WebhookInterval, cfg.RequestTimeout)
+	}
+
+	var taker *snapshotTaker
+	if googleSnapshots != nil && cfg.SnapshotInterval > 0 {
+		taker = newSnapshotTaker(goog, googleSnapshots, cfg.SnapshotInterval, cfg.RequestTimeout)
+	}
 
 	mux := http.NewServeMux()
 
-	mux.Handle("/", statusLogging(showEndpoints(goog)))
-	mux.Handle(goog.Books(), statusLogging(app.Handler(goog.HandleBooks)))
-	mux.Handle(goog.Connect(), statusLogging(app.Handler(goog.HandleConnect)))
-	mux.Handle(goog.Disconnect(), statusLogging(app.Handler(goog.HandleDisconnect)))
-	mux.Handle(goog.OAuthCallback(), statusLogging(app.Handler(goog.HandleOAuthCallback)))
+	mux.Handle("/", showEndpoints(registry))
+	mux.Handle("/health", showHealth(registry))
+	mux.Handle("/library", app.Timeout(cfg.RequestTimeout, showLibrary(registry)))
+	mux.Handle("/exports", app.Timeout(cfg.RequestTimeout, showExports(exp)))
+	if cfg.Metrics {
+		mux.Handle("/metrics", showMetrics(newMetricsRegistry()))
+	}
+	registry.Mount(mux, func(h http.Handler) http.Handler {
+		return app.Timeout(cfg.RequestTimeout, h)
+	})
+	newAccountService(registry, cfg.AllowSignup, login, sender).Mount(mux, func(h http.Handler) http.Handler {
+		return app.Timeout(cfg.RequestTimeout, h)
+	})
+
+	server := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           withTracing(mux, withRequestLogging(registry, mux, withMetrics(mux, withAPITokens(registry, mux)))),
+		ReadHeaderTimeout: cfg.ReadTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server.RegisterOnShutdown(cancel)
+
+	if exp != nil {
+		go exp.Run(ctx)
+	}
 
-	logOut.Printf("Starting server on port %s\n", port)
-	http.ListenAndServe(":"+port, mux)
+	if watcher != nil {
+		go watcher.Run(ctx)
+	}
+
+	if taker != nil {
+		go taker.Run(ctx)
+	}
+
+	err = serve(server, cfg.TLSCertFile, cfg.TLSKeyFile)
+	if tp != nil {
+		// XXX sending the spans still in the batch
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		if err := tp.Shutdown(ctx); err != nil {
+			logger.Error(errCantFlushTraces(err))
+		}
+		cancel()
+	}
+
+	if err != nil {
+		logger.Errorf("Server failed: %v", err)
+		os.Exit(1)
+	}
+
+	logger.Info("Server stopped")
 }
 
-func showEndpoints(routers ...app.Router) app.Handler {
-	var endpoints []string
-	for _, r := range routers {
-		endpoints = append(endpoints, r.Books(), r.Connect(), r.Disconnect(), r.OAuthCallback())
+// serve runs the server, over TLS if certFile and keyFile are given, until it fails or a SIGINT or SIGTERM arrives.
+// In the latter case, the server stops accepting new connections and waits up to cfg.ShutdownTimeout for the
+// in-flight requests to finish.
+func serve(server *http.Server, certFile, keyFile string) error {
+	errs := make(chan error, 1)
+	go func() {
+		if certFile != "" {
+			logger.Infof("Starting HTTPS server on port %s", cfg.Port)
+			errs <- server.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			logger.Infof("Starting server on port %s", cfg.Port)
+			errs <- server.ListenAndServe()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-errs:
+		return err // XXX never http.ErrServerClosed, since only serve calls Shutdown
+	case sig := <-signals:
+		logger.Infof("Received %v; shutting down (waiting up to %v for in-flight requests)", sig, cfg.ShutdownTimeout)
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		return errCantShutDown(err)
+	}
+
+	return nil
+}
+
+func showEndpoints(registry *app.Registry) app.Handler {
 	return app.Handler(func(w http.ResponseWriter, r *http.Request) *app.Error {
+		var endpoints []string
+		for _, p := range registry.Providers() {
+			endpoints = append(endpoints, app.Endpoints(p)...)
+		}
+
 		endpointsJSON, err := json.Marshal(endpoints)
 		if err != nil {
 			return app.Wrap(err, http.StatusInternalServerError)
@@ -403,6 +1257,119 @@ func showEndpoints(routers ...app.Router) app.Handler {
 	})
 }
 
+// librarySource describes what a single provider contributed to the merged library.
+type librarySource struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Books  int    `json:"books"`
+	Error  string `json:"error,omitempty"`
+}
+
+// showLibrary merges the user's books from every provider they're connected to, so each book shows up once, with the
+// providers it was found in. Providers the user isn't connected to are skipped, and those which fail are reported
+// without failing the whole response: as a JSON object alongside the books, or as Warning headers for CSV.
+func showLibrary(registry *app.Registry) app.Handler {
+	return app.Handler(func(w http.ResponseWriter, r *http.Request) *app.Error {
+		// XXX the providers read the session concurrently; loading it here first means they only read the
+		// request's session registry, instead of racing to fill it
+		if _, err := store.Get(r, sessionName); err != nil {
+			// TODO ignoring session errors
+			//return app.Wrap(errSessionError(sessionName, err), http.StatusInternalServerError)
+		}
+
+		logFrom(r.Context()).Info("Getting the books from every provider")
+		library := libris.NewLibrary()
+		sources := []librarySource{}
+		// XXX requests with an API token only get the providers it covers
+		include := func(p app.Provider) bool {
+			auth, ok := requestAPIToken(r)
+			return !ok || auth.token.Allows(p.Name(), "")
+		}
+
+		for _, listing := range registry.ListBooks(r, include) {
+			source := librarySource{Name: listing.Name, Status: "ok", Books: len(listing.Books)}
+
+			if appErr := app.Wrap(listing.Err, http.StatusInternalServerError); appErr == nil {
+				library.Add(listing.Name, listing.Books)
+			} else if appErr.Status == http.StatusUnauthorized {
+				source.Status = "disconnected"
+			} else {
+				logFrom(r.Context()).Warnf("Couldn't get the books from %s: %v", listing.Name, appErr)
+				source.Status = "error"
+				source.Error = appErr.Message
+			}
+
+			sources = append(sources, source)
+		}
+
+		bs := library.Books()
+		logFrom(r.Context()).Infof("%d books after merging", len(bs))
+
+		contentType := httputil.NegotiateContentType(r,
+			[]string{"application/json", "text/csv", "application/csv"},
+			"application/json")
+		if contentType != "application/json" {
+			for _, source := range sources {
+				if source.Status == "error" {
+					w.Header().Add("Warning", fmt.Sprintf("199 mea-libris %q", source.Name+": "+source.Error))
+				}
+			}
+
+			return app.Wrap(encodeBooksAsCSV(bs, w), http.StatusInternalServerError)
+		}
+
+		libraryJSON, err := json.Marshal(struct {
+			Books   libris.Books    `json:"books"`
+			Sources []librarySource `json:"sources"`
+		}{bs, sources})
+		if err != nil {
+			return app.Wrap(errCantEncodeBooks(err), http.StatusInternalServerError)
+		}
+
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		_, err = fmt.Fprintf(w, "%s", libraryJSON)
+		if err != nil {
+			return app.Wrap(err, http.StatusInternalServerError)
+		}
+
+		return nil
+	})
+}
+
+// showHealth reports the health of every registered provider. Answers 503 if any of them is in trouble.
+func showHealth(registry *app.Registry) app.Handler {
+	return app.Handler(func(w http.ResponseWriter, r *http.Request) *app.Error {
+		providers := registry.Health(r.Context())
+
+		status := "ok"
+		for _, h := range providers {
+			if h.Status != "ok" {
+				status = "degraded"
+			}
+		}
+
+		healthJSON, err := json.Marshal(struct {
+			Status    string       `json:"status"`
+			Providers []app.Health `json:"providers"`
+		}{status, providers})
+		if err != nil {
+			return app.Wrap(err, http.StatusInternalServerError)
+		}
+
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		if status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		_, err = fmt.Fprintf(w, "%s", healthJSON)
+		if err != nil {
+			return app.Wrap(err, http.StatusInternalServerError)
+		}
+
+		return nil
+	})
+}
+
 // HANDLERS & MIDDLEWARES
 
 // logging middleware
@@ -411,11 +1378,13 @@ type statusResponseWriter interface {
 	http.Flusher
 
 	Status() int
+	Bytes() int
 }
 
 type statusResponseLogger struct {
 	w      http.ResponseWriter
 	status int
+	bytes  int
 }
 
 func (s *statusResponseLogger) Header() http.Header {
@@ -427,7 +1396,9 @@ func (s *statusResponseLogger) Write(b []byte) (int, error) {
 		s.status = http.StatusOK
 	}
 
-	return s.w.Write(b)
+	n, err := s.w.Write(b)
+	s.bytes += n
+	return n, err
 }
 
 func (s *statusResponseLogger) WriteHeader(status int) {
@@ -439,73 +1410,257 @@ func (s *statusResponseLogger) Status() int {
 	return s.status
 }
 
+// Bytes returns how many bytes of the body were written.
+func (s *statusResponseLogger) Bytes() int {
+	return s.bytes
+}
+
 func (s *statusResponseLogger) Flush() {
 	if f, ok := s.w.(http.Flusher); ok {
 		f.Flush()
 	}
 }
 
-func statusLogging(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		lw := &statusResponseLogger{w: w, status: http.StatusOK}
+// APPLICATION ERRORS
+var errMissingCredentials = errors.New("This app's OAuth credentials are missing.")
 
-		h.ServeHTTP(lw, r)
+func errInvalidQueryValue(param, value string, allowed []string) error {
+	return fmt.Errorf("Invalid value for %s: %s. Expected one of %v", param, value, allowed)
+}
 
-		switch {
-		case lw.Status() < 100:
-			logErr.Printf("Response: Unknown code %d. Something very strange is a-brewing...\n", lw.Status())
-		case lw.Status() < 200:
-			logOut.Printf("Response: [Informational] %d: %s\n", lw.Status(), http.StatusText(lw.Status()))
-		case lw.Status() < 300:
-			logOut.Printf("Response: [Success] %d: %s\n", lw.Status(), http.StatusText(lw.Status()))
-		case lw.Status() < 400:
-			logOut.Printf("Response: [Redirection] %d: %s\n", lw.Status(), http.StatusText(lw.Status()))
-		case lw.Status() < 500:
-			logErr.Printf("Response: [Client Error] %d: %s\n", lw.Status(), http.StatusText(lw.Status()))
-		case lw.Status() < 600:
-			logErr.Printf("Response: [Server Error] %d: %s\n", lw.Status(), http.StatusText(lw.Status()))
-		default:
-			logErr.Printf("Response: Unknown code %d. Something very strange is a-brewing...\n", lw.Status())
-		}
-	})
+func errCantLoadBooksClient(err error) error {
+	return fmt.Errorf("Couldn't load Google Books client: %w", err)
 }
 
-// APPLICATION ERRORS
-func errInvalidState(expected, actual string) error {
-	return fmt.Errorf("Invalid state parameter: expected %s; got %s", expected, actual)
+func errCantLoadVolumes(err error) error {
+	return fmt.Errorf("Couldn't load the user's volumes: %w", err)
 }
 
-func errCallbackError(message string) error {
-	return fmt.Errorf("Callback received error: %v", message)
+func errCantEncodeBooks(err error) error {
+	return fmt.Errorf("Couldn't encode the books: %w", err)
 }
 
-var errCodeNotFound = errors.New("Code not found.")
+func errInvalidConfig(problems []string) error {
+	return fmt.Errorf("Invalid configuration:\n\t%s", strings.Join(problems, "\n\t"))
+}
 
-var errAccessTokenNotFound = errors.New("User not authorized. Use the /google/connect endpoint.")
+func errUnexpectedArguments(args []string) error {
+	return fmt.Errorf("Unexpected arguments: %v", args)
+}
 
-func errTokenExchangeError(err error) error {
-	return fmt.Errorf("Problem with token exchange: %v", err)
+func errCantReadConfigFile(path string, err error) error {
+	return fmt.Errorf("Couldn't read the config file %s: %w", path, err)
 }
 
-func errCantLoadBooksClient(err error) error {
-	return fmt.Errorf("Couldn't load Google Books client: %v", err)
+func errCantShutDown(err error) error {
+	return fmt.Errorf("Couldn't shut down gracefully: %w", err)
 }
 
-func errCantLoadVolumes(err error) error {
-	return fmt.Errorf("Couldn't load the user's volumes: %v", err)
+func errCantTrace(err error) error {
+	return fmt.Errorf("Couldn't set up tracing: %w", err)
 }
 
-func errCantEncodeBooks(err error) error {
-	return fmt.Errorf("Couldn't encode the books: %v", err)
+func errCantFlushTraces(err error) error {
+	return fmt.Errorf("Couldn't send the last traces: %w", err)
+}
+
+func errInvalidOTLPEndpoint(endpoint string) error {
+	return fmt.Errorf("%q isn't an http:// or https:// URL", endpoint)
+}
+
+var errOpenLibraryUsernameNotFound = errors.New("No Open Library user. Use the /openlibrary/connect?username=<your username> endpoint.")
+
+func errInvalidOpenLibraryUsername(username string) error {
+	return fmt.Errorf("Invalid Open Library username: %s", username)
+}
+
+func errOpenLibraryUserNotFound(username string) error {
+	return fmt.Errorf("Open Library user %s not found.", username)
+}
+
+func errPrivateReadingLog(username string) error {
+	return fmt.Errorf("The reading log of Open Library user %s isn't public.", username)
+}
+
+func errCantLoadReadingLog(err error) error {
+	return fmt.Errorf("Couldn't load the user's reading log: %w", err)
+}
+
+func errNoOAuth(provider string) error {
+	return fmt.Errorf("The %s provider doesn't use OAuth.", provider)
+}
+
+func errUnexpectedStatus(status string) error {
+	return fmt.Errorf("Unexpected response: %s", status)
+}
+
+func errMethodNotAllowed(method string) error {
+	return fmt.Errorf("Method %s not allowed.", method)
+}
+
+var errNothingImported = errors.New("Nothing imported. POST a Goodreads or StoryGraph CSV export to /import/ first.")
+
+func errExportNotFound(err error) error {
+	return fmt.Errorf("No export found in the file field: %w", err)
+}
+
+func errExportTooLarge(limit int64) error {
+	return fmt.Errorf("The export is too large; at most %d MiB are accepted", limit>>20)
+}
+
+func errCantImport(err error) error {
+	return fmt.Errorf("Couldn't import the export: %w", err)
+}
+
+func errCantLoadImportedBooks(err error) error {
+	return fmt.Errorf("Couldn't load the imported books: %w", err)
+}
+
+func errCantStoreImportedBooks(err error) error {
+	return fmt.Errorf("Couldn't store the imported books: %w", err)
+}
+
+func errCantOpenCalibreLibrary(path string, err error) error {
+	return fmt.Errorf("Couldn't open the Calibre library at %s: %w", path, err)
+}
+
+func errCantReadCalibreLibrary(err error) error {
+	return fmt.Errorf("Couldn't read the Calibre library: %w", err)
+}
+
+func errCantScanFolder(err error) error {
+	return fmt.Errorf("Couldn't scan the book folder: %w", err)
+}
+
+var errNoOPFPackage = errors.New("No OPF package found in the EPUB.")
+
+func errFileNotInArchive(name string) error {
+	return fmt.Errorf("File %s not found in the archive.", name)
+}
+
+var errNotLoggedIn = errors.New("Not logged in. Use the /account/login or /account/signup endpoints.")
+
+var errSignupDisabled = errors.New("Signing up is disabled in this instance.")
+
+func errInvalidUsername(username string) error {
+	return fmt.Errorf("Invalid username %q: use up to 64 letters, digits, or any of _.@-", username)
+}
+
+var errPasswordTooShort = fmt.Errorf("Passwords must have at least %d characters.", minPasswordLength)
+
+var errInvalidCredentials = errors.New("Invalid username or password.")
+
+func errCantCreateAccount(err error) error {
+	return fmt.Errorf("Couldn't create the account: %w", err)
 }
 
-func errCantRevokeToken(err error) error {
-	return fmt.Errorf("Failed to revoke token for the current user: %v", err)
+func errCantLoadAccount(err error) error {
+	return fmt.Errorf("Couldn't load the account: %w", err)
+}
+
+func errCantSaveAccount(err error) error {
+	return fmt.Errorf("Couldn't save the account: %w", err)
+}
+
+var errNoSessionResponse = errors.New("The session can't be saved without a response.")
+
+var errInvalidCSRFToken = errors.New("Invalid CSRF token. Get one from /account/csrf, and send it in the " +
+	"X-CSRF-Token header or the csrf_token form field.")
+
+func errNothingToLink(provider string) error {
+	return fmt.Errorf("This session has no connection to %q to link.", provider)
+}
+
+func errCantDiscoverOIDCIssuer(issuer string, err error) error {
+	return fmt.Errorf("Couldn't discover the OIDC issuer %s: %w", issuer, err)
+}
+
+var errInvalidOIDCState = errors.New("Invalid OIDC state. Try logging in again.")
+
+var errInvalidOIDCNonce = errors.New("Invalid OIDC nonce.")
+
+var errOIDCCodeNotFound = errors.New("OIDC code not found.")
+
+var errIDTokenNotFound = errors.New("No ID token in the OIDC response.")
+
+var errChangesDisabled = errors.New("Snapshots are disabled in this instance, so changes can't be told.")
+
+var errChangesNeedAccount = errors.New("Changes are only kept for accounts. Use the /account/login or /account/signup endpoints.")
+
+func errCantRecordSnapshot(err error) error {
+	return fmt.Errorf("Couldn't record a snapshot of the user's books: %w", err)
+}
+
+func errCantLoadSnapshot(err error) error {
+	return fmt.Errorf("Couldn't load the snapshot of the user's books: %w", err)
+}
+
+func errSnapshotNotFound(since string) error {
+	return fmt.Errorf("No snapshot found for %s; it may be too old. Sync again without since.", since)
+}
+
+var errExportsDisabled = errors.New("Exports are disabled in this instance.")
+
+func errCantExport(user string, err error) error {
+	return fmt.Errorf("Couldn't export the books of %s: %w", user, err)
+}
+
+var errInvalidAPIToken = errors.New("Invalid API token. It may have been revoked.")
+
+func errAPITokenNotAllowed(path, format string) error {
+	if format == "" {
+		return fmt.Errorf("API tokens can't be used for %s.", path)
+	}
+
+	return fmt.Errorf("This API token can't be used for %s as %s.", path, format)
+}
+
+var errAPITokenNameNotFound = errors.New("API tokens need a name.")
+
+func errAPITokenNotFound(id string) error {
+	return fmt.Errorf("API token %s not found.", id)
+}
+
+var errWebhooksDisabled = errors.New("Webhooks are disabled in this instance.")
+
+func errInvalidWebhookURL(url string) error {
+	return fmt.Errorf("Invalid webhook URL %q: it must be an absolute http or https URL.", url)
+}
+
+var errTooManyWebhooks = fmt.Errorf("Accounts can't have more than %d webhooks.", maxWebhooks)
+
+func errWebhookNotFound(id string) error {
+	return fmt.Errorf("Webhook %s not found.", id)
+}
+
+func errCantTakeSnapshot(user string, err error) error {
+	return fmt.Errorf("Couldn't take a snapshot of the books of %s: %w", user, err)
+}
+
+func errCantPollBooks(user string, err error) error {
+	return fmt.Errorf("Couldn't check the books of %s for changes: %w", user, err)
+}
+
+func errOIDCLoginFailed(err error) error {
+	return fmt.Errorf("Couldn't log in through OIDC: %w", err)
 }
 
 // UTILITIES
-func randomString() string {
-	return fmt.Sprintf("st%d", time.Now().UnixNano())
+
+// cacheUser identifies a user in the cache, without keeping their token around.
+func cacheUser(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomID returns a random, unguessable identifier.
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // XXX crypto/rand failing means something is very wrong with the system
+	}
+
+	return hex.EncodeToString(b)
 }
 
 func defaultTo(v string, def string) string {
@@ -515,3 +1670,22 @@ func defaultTo(v string, def string) string {
 
 	return v
 }
+
+func defaultToSlice(v []string, def []string) []string {
+	if len(v) == 0 {
+		return def
+	}
+
+	return v
+}
+
+// lookupFold returns the element of values equal to v under Unicode case-folding, if any.
+func lookupFold(values []string, v string) (string, bool) {
+	for _, value := range values {
+		if strings.EqualFold(value, v) {
+			return value, true
+		}
+	}
+
+	return "", false
+}
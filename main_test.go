@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hanjos/mea-libris/app"
+	"google.golang.org/api/books/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// googleStandIn serves the user's volumes like the Books API does, but never more than pageSize of them at a time,
+// however many were asked for. Pages starting at an index mapped to a status code get that instead.
+type googleStandIn struct {
+	total    int
+	pageSize int
+	statuses map[int]int // by start index
+}
+
+func (s *googleStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	startIndex, _ := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	maxResults, _ := strconv.Atoi(r.URL.Query().Get("maxResults"))
+
+	if status, ok := s.statuses[startIndex]; ok {
+		w.WriteHeader(status)
+		return
+	}
+
+	end := startIndex + maxResults
+	if end > startIndex+s.pageSize {
+		end = startIndex + s.pageSize
+	}
+	if end > s.total {
+		end = s.total
+	}
+
+	volumes := &books.Volumes{TotalItems: int64(s.total)}
+	for i := startIndex; i < end; i++ {
+		volumes.Items = append(volumes.Items, &books.Volume{
+			Id:         strconv.Itoa(i),
+			AccessInfo: &books.VolumeAccessInfo{},
+			VolumeInfo: &books.VolumeVolumeInfo{Title: "Book " + strconv.Itoa(i)},
+		})
+	}
+
+	json.NewEncoder(w).Encode(volumes)
+}
+
+func newGoogleTest(t *testing.T, standIn *googleStandIn, workers int) *books.Service {
+	cfg = &Config{GooglePageWorkers: workers, GoogleCallTimeout: 5 * time.Second}
+
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+
+	svc, err := newGoogleBooksClient(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc.BasePath = server.URL + "/"
+	return svc
+}
+
+func TestGetGoogleBooksShortPages(t *testing.T) {
+	tests := []struct {
+		total, pageSize int
+	}{
+		{0, googleMaxResults},
+		{googleMaxResults, googleMaxResults},
+		{3*googleMaxResults + 7, googleMaxResults},
+		{3*googleMaxResults + 7, 30},
+		{100, 7},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d books, %d per page", test.total, test.pageSize), func(t *testing.T) {
+			svc := newGoogleTest(t, &googleStandIn{total: test.total, pageSize: test.pageSize}, 4)
+
+			bs, err := getGoogleBooks(t.Context(), svc, &googleBooksQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(bs) != test.total {
+				t.Fatalf("got %d books, want %d", len(bs), test.total)
+			}
+
+			for i, b := range bs {
+				if want := "Book " + strconv.Itoa(i); b.Title != want {
+					t.Errorf("book %d: got title %q, want %q", i, b.Title, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetGoogleBooksFirstError(t *testing.T) {
+	// XXX a single worker leaves the other pages waiting for it, to be cancelled once the last page fails
+	standIn := &googleStandIn{
+		total:    5 * googleMaxResults,
+		pageSize: googleMaxResults,
+		statuses: map[int]int{4 * googleMaxResults: http.StatusForbidden},
+	}
+
+	for i := 0; i < 10; i++ {
+		svc := newGoogleTest(t, standIn, 1)
+
+		_, err := getGoogleBooks(t.Context(), svc, &googleBooksQuery{})
+
+		var apiErr *googleapi.Error
+		if !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+			t.Fatalf("got the error %v, want the page's 403", err)
+		}
+	}
+}
+
+func TestCheckNotModified(t *testing.T) {
+	modified := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	entry := &app.CacheEntry{ETag: `W/"abc"`, LastModified: modified}
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		etag   string
+		status int
+	}{
+		{"JSON", map[string]string{}, `W/"abc-json"`, http.StatusOK},
+		{"CSV", map[string]string{"Accept": "text/csv"}, `W/"abc-csv"`, http.StatusOK},
+		{"same JSON", map[string]string{"If-None-Match": `W/"abc-json"`}, `W/"abc-json"`, http.StatusNotModified},
+		{"same CSV", map[string]string{"Accept": "text/csv", "If-None-Match": `"x", W/"abc-csv"`}, `W/"abc-csv"`,
+			http.StatusNotModified},
+		{"JSON's ETag, for CSV", map[string]string{"Accept": "text/csv", "If-None-Match": `W/"abc-json"`},
+			`W/"abc-csv"`, http.StatusOK},
+		{"the books' own ETag", map[string]string{"If-None-Match": `W/"abc"`}, `W/"abc-json"`, http.StatusOK},
+		{"any", map[string]string{"If-None-Match": "*"}, `W/"abc-json"`, http.StatusNotModified},
+		{"not modified since", map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)},
+			`W/"abc-json"`, http.StatusNotModified},
+		{"modified since", map[string]string{"If-Modified-Since": modified.Add(-time.Hour).Format(http.TimeFormat)},
+			`W/"abc-json"`, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/google/", nil)
+			for key, value := range test.header {
+				r.Header.Set(key, value)
+			}
+
+			w := httptest.NewRecorder()
+			notModified := checkNotModified(w, r, entry)
+
+			if got := w.Header().Get("ETag"); got != test.etag {
+				t.Errorf("got ETag %s, want %s", got, test.etag)
+			}
+
+			if got := w.Header().Get("Vary"); got != "Accept, Cookie, Authorization" {
+				t.Errorf("got Vary %q", got)
+			}
+
+			if notModified != (test.status == http.StatusNotModified) || w.Code != test.status {
+				t.Errorf("got status %d (not modified: %t), want %d", w.Code, notModified, test.status)
+			}
+		})
+	}
+}
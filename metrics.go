@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hanjos/mea-libris/libris"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// metricsNamespace prefixes every metric's name.
+const metricsNamespace = "mealibris"
+
+// The metrics exposed in /metrics. They're updated even if the endpoint is disabled, which costs next to nothing.
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, by route and status class.",
+	}, []string{"route", "code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "How long HTTP requests took to serve, by route and status class.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"route", "code"})
+
+	googleCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "google_api_calls_total",
+		Help:      "Calls made to Google's APIs, retries included, by API and status class (error if there was no response).",
+	}, []string{"api", "code"})
+
+	googleCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "google_api_call_duration_seconds",
+		Help:      "How long calls to Google's APIs took, by API.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"api"})
+
+	googlePages = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "google_pages_fetched",
+		Help:      "How many pages of volumes were fetched from Google for each library.",
+		Buckets:   []float64{1, 2, 5, 10, 20, 50, 100},
+	})
+
+	booksReturned = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "books_returned",
+		Help:      "How many books each listing of a user's books returned, by provider.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"provider"})
+
+	tokenRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "oauth_token_refreshes_total",
+		Help:      "OAuth access tokens refreshed, by provider and result (ok or error).",
+	}, []string{"provider", "result"})
+
+	googleCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "google_cache_lookups_total",
+		Help:      "Lookups in the cache of Google books, by result (hit, miss or bypass, when fresh books were asked for).",
+	}, []string{"result"})
+)
+
+// newMetricsRegistry returns a registry with every metric above, along with the Go runtime's and the process'.
+func newMetricsRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		httpRequests,
+		httpRequestDuration,
+		googleCalls,
+		googleCallDuration,
+		googlePages,
+		booksReturned,
+		tokenRefreshes,
+		googleCacheLookups,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return reg
+}
+
+// showMetrics sends every metric in reg, in Prometheus' format.
+func showMetrics(reg *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{ErrorLog: errorLogger{logrus.NewEntry(logger)}})
+}
+
+// withMetrics counts every request h serves, and how long it took, by the mux route it matched. Routes are the
+// patterns registered in the mux, not the paths requested, so there are only so many of them.
+func withMetrics(mux *http.ServeMux, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusResponseLogger{w: w, status: http.StatusOK}
+
+		h.ServeHTTP(sw, r)
+
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "none"
+		}
+
+		code := statusClass(sw.Status())
+		httpRequests.WithLabelValues(route, code).Inc()
+		httpRequestDuration.WithLabelValues(route, code).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusClass returns the class of the given status code, e.g. 4xx.
+func statusClass(status int) string {
+	if status < 100 || status >= 600 {
+		return "unknown"
+	}
+
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// googleMetricsTransport counts every call made to Google's APIs, and how long it took.
+type googleMetricsTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t googleMetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	api := googleAPI(req)
+	start := time.Now()
+
+	resp, err := t.base.RoundTrip(req)
+
+	googleCallDuration.WithLabelValues(api).Observe(time.Since(start).Seconds())
+	if err != nil {
+		googleCalls.WithLabelValues(api, "error").Inc()
+	} else {
+		googleCalls.WithLabelValues(api, statusClass(resp.StatusCode)).Inc()
+	}
+
+	return resp, err
+}
+
+// googleAPI tells which of Google's APIs the request is for: books, oauth (tokens being exchanged, refreshed or
+// revoked) or other.
+func googleAPI(req *http.Request) string {
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/books/"):
+		return "books"
+	case req.URL.Host == "oauth2.googleapis.com" || req.URL.Host == "accounts.google.com":
+		return "oauth"
+	default:
+		return "other"
+	}
+}
+
+// observeBooks records how many books a listing of the given provider returned.
+func observeBooks(provider string, bs libris.Books) {
+	booksReturned.WithLabelValues(provider).Observe(float64(len(bs)))
+}
+
+// observeTokenRefresh is app.OAuthProvider's OnRefresh hook, counting token refreshes.
+func observeTokenRefresh(provider string) func(token *oauth2.Token, err error) {
+	return func(token *oauth2.Token, err error) {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+
+		tokenRefreshes.WithLabelValues(provider, result).Inc()
+	}
+}
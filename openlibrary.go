@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+
+	"github.com/hanjos/mea-libris/app"
+	"github.com/hanjos/mea-libris/libris"
+)
+
+// openLibraryShelves are the reading log shelves Open Library keeps for each user.
+var openLibraryShelves = []string{"want-to-read", "currently-reading", "already-read"}
+
+// openLibraryUsernamePattern matches valid Open Library usernames, which end up in URL paths.
+var openLibraryUsernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// openLibraryProvider lists the books in a user's Open Library reading log. Open Library's API needs no credentials,
+// as long as the reading log is public, so connecting just means telling which user to look at.
+type openLibraryProvider struct {
+	app.Router
+
+	baseURL string
+	client  *http.Client
+}
+
+func newOpenLibraryProvider(baseURL string, client *http.Client) *openLibraryProvider {
+	return &openLibraryProvider{
+		Router:  app.NewRouter("/openlibrary"),
+		baseURL: baseURL,
+		client:  client,
+	}
+}
+
+// Name implements the app.Provider interface.
+func (ol *openLibraryProvider) Name() string {
+	return "openlibrary"
+}
+
+// HandleBooks lists the books in the reading log of the connected user, or of the one given in the username query
+// parameter. The shelf query parameter, which may be repeated or hold comma-separated values, picks which shelves
+// are included; all of them, by default.
+func (ol *openLibraryProvider) HandleBooks(w http.ResponseWriter, r *http.Request) *app.Error {
+	bs, err := ol.ListBooks(r)
+	if err != nil {
+		return app.Wrap(err, http.StatusBadGateway)
+	}
+
+	err = encodeBooks(bs, w, r)
+	if err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+// ListBooks implements the app.Lister interface.
+func (ol *openLibraryProvider) ListBooks(r *http.Request) (libris.Books, error) {
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		username = connection(r, ol.Name())
+	}
+
+	if username == "" {
+		return nil, app.Wrap(errOpenLibraryUsernameNotFound, http.StatusUnauthorized)
+	} else if !openLibraryUsernamePattern.MatchString(username) {
+		return nil, app.Wrap(errInvalidOpenLibraryUsername(username), http.StatusBadRequest)
+	}
+
+	shelves, err := queryValues(r, "shelf", openLibraryShelves)
+	if err != nil {
+		return nil, app.Wrap(err, http.StatusBadRequest)
+	}
+
+	bs, err := getOpenLibraryBooks(r.Context(), ol.client, ol.baseURL, username, defaultToSlice(shelves, openLibraryShelves))
+	if err != nil {
+		return nil, app.Wrap(err, http.StatusBadGateway)
+	}
+
+	observeBooks(ol.Name(), bs)
+	return bs, nil
+}
+
+// HandleConnect remembers the Open Library user given in the username query parameter for this session, or for the
+// account the user is logged into.
+func (ol *openLibraryProvider) HandleConnect(w http.ResponseWriter, r *http.Request) *app.Error {
+	username := r.FormValue("username")
+	if username == "" {
+		if current := connection(r, ol.Name()); current != "" {
+			fmt.Fprintf(w, "Connected as %s!\n", current)
+			return nil
+		}
+
+		return app.Wrap(errOpenLibraryUsernameNotFound, http.StatusBadRequest)
+	} else if !openLibraryUsernamePattern.MatchString(username) {
+		return app.Wrap(errInvalidOpenLibraryUsername(username), http.StatusBadRequest)
+	}
+
+	logFrom(r.Context()).Infof("Connecting to Open Library as %s", username)
+	if err := saveConnection(w, r, ol.Name(), username); err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	fmt.Fprintf(w, "Connected as %s!\n", username)
+	return nil
+}
+
+// HandleDisconnect forgets the Open Library user, for this session or the account the user is logged into.
+func (ol *openLibraryProvider) HandleDisconnect(w http.ResponseWriter, r *http.Request) *app.Error {
+	if connection(r, ol.Name()) == "" {
+		fmt.Fprintln(w, "User wasn't connected. Nothing was done.")
+		return nil
+	}
+
+	if err := saveConnection(w, r, ol.Name(), ""); err != nil {
+		return app.Wrap(err, http.StatusInternalServerError)
+	}
+
+	fmt.Fprintln(w, "User disconnected!")
+	return nil
+}
+
+// HandleOAuthCallback has nothing to do, since Open Library doesn't use OAuth.
+func (ol *openLibraryProvider) HandleOAuthCallback(w http.ResponseWriter, r *http.Request) *app.Error {
+	return app.Wrap(errNoOAuth(ol.Name()), http.StatusNotFound)
+}
+
+// STEP FUNCTIONS
+
+// openLibraryReadingLog is a page of a user's reading log shelf, as returned by Open Library.
+type openLibraryReadingLog struct {
+	Page     int `json:"page"`
+	NumFound int `json:"numFound"`
+	Entries  []struct {
+		Work struct {
+			Title            string   `json:"title"`
+			Key              string   `json:"key"`
+			AuthorNames      []string `json:"author_names"`
+			FirstPublishYear int      `json:"first_publish_year"`
+		} `json:"work"`
+		LoggedEdition string `json:"logged_edition"`
+	} `json:"reading_log_entries"`
+}
+
+// getOpenLibraryBooks lists the books in the given shelves of a user's reading log.
+func getOpenLibraryBooks(ctx context.Context, client *http.Client, baseURL, username string, shelves []string) ([]*libris.Book, error) {
+	logFrom(ctx).Infof("Getting %s's books from Open Library (shelves: %v)", username, shelves)
+
+	myBooks := []*libris.Book{}
+	for _, shelf := range shelves {
+		found := 0
+		for page := 1; ; page++ {
+			readingLog, err := getOpenLibraryReadingLog(ctx, client, baseURL, username, shelf, page)
+			if err != nil {
+				return nil, err
+			}
+
+			found += len(readingLog.Entries)
+			for _, entry := range readingLog.Entries {
+				myBooks = append(myBooks, &libris.Book{
+					Title:          entry.Work.Title,
+					Authors:        entry.Work.AuthorNames,
+					Identifier:     path.Base(entry.Work.Key),
+					IdentifierType: "OPEN_LIBRARY",
+					Shelf:          shelf,
+				})
+			}
+
+			// XXX the last page is either short or empty
+			if len(readingLog.Entries) == 0 || found >= readingLog.NumFound {
+				break
+			}
+		}
+	}
+
+	logFrom(ctx).Infof("%d books processed", len(myBooks))
+	return myBooks, nil
+}
+
+// getOpenLibraryReadingLog fetches a single page of a reading log shelf.
+func getOpenLibraryReadingLog(ctx context.Context, client *http.Client, baseURL, username, shelf string, page int) (*openLibraryReadingLog, error) {
+	u := baseURL + "/people/" + url.PathEscape(username) + "/books/" + shelf + ".json?page=" + strconv.Itoa(page)
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, errCantLoadReadingLog(err)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errCantLoadReadingLog(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, app.Wrap(errOpenLibraryUserNotFound(username), http.StatusNotFound)
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return nil, app.Wrap(errPrivateReadingLog(username), http.StatusForbidden)
+	default:
+		return nil, errCantLoadReadingLog(errUnexpectedStatus(resp.Status))
+	}
+
+	readingLog := &openLibraryReadingLog{}
+	if err := json.NewDecoder(resp.Body).Decode(readingLog); err != nil {
+		return nil, errCantLoadReadingLog(err)
+	}
+
+	return readingLog, nil
+}
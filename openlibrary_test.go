@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hanjos/mea-libris/app"
+	"github.com/hanjos/mea-libris/libris"
+)
+
+// openLibraryEntry is a reading log entry, as the stand-in API serves it.
+type openLibraryEntry struct {
+	Title   string
+	Key     string
+	Authors []string
+}
+
+// openLibraryStandIn serves reading logs like Open Library does, pageSize entries per page, from the shelves of each
+// user. Users mapped to a status code get that instead. It also counts the pages requested, by user, shelf and page.
+type openLibraryStandIn struct {
+	pageSize int
+	users    map[string]map[string][]openLibraryEntry // by username, then shelf
+	statuses map[string]int                           // by username
+
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func (s *openLibraryStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// XXX /people/<username>/books/<shelf>.json
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 5 || parts[1] != "people" || parts[3] != "books" || !strings.HasSuffix(parts[4], ".json") {
+		http.NotFound(w, r)
+		return
+	}
+
+	username, shelf := parts[2], strings.TrimSuffix(parts[4], ".json")
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+
+	s.mu.Lock()
+	s.requests[fmt.Sprintf("%s/%s/%d", username, shelf, page)]++
+	s.mu.Unlock()
+
+	if status, ok := s.statuses[username]; ok {
+		w.WriteHeader(status)
+		return
+	}
+
+	shelves, ok := s.users[username]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	all := shelves[shelf]
+	start, end := (page-1)*s.pageSize, page*s.pageSize
+	if start > len(all) {
+		start = len(all)
+	}
+	if end > len(all) {
+		end = len(all)
+	}
+
+	type work struct {
+		Title       string   `json:"title"`
+		Key         string   `json:"key"`
+		AuthorNames []string `json:"author_names"`
+	}
+	type entry struct {
+		Work work `json:"work"`
+	}
+
+	entries := []entry{}
+	for _, e := range all[start:end] {
+		entries = append(entries, entry{work{e.Title, e.Key, e.Authors}})
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"page":                page,
+		"numFound":            len(all),
+		"reading_log_entries": entries,
+	})
+}
+
+func newOpenLibraryTest(t *testing.T, standIn *openLibraryStandIn) *openLibraryProvider {
+	standIn.requests = map[string]int{}
+
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+
+	return newOpenLibraryProvider(server.URL, server.Client())
+}
+
+func listOpenLibraryBooks(ol *openLibraryProvider, query string) (libris.Books, error) {
+	r := httptest.NewRequest("GET", "/openlibrary/?"+query, nil)
+	return ol.ListBooks(r)
+}
+
+func TestOpenLibraryMultiplePages(t *testing.T) {
+	var entries []openLibraryEntry
+	for i := 0; i < 7; i++ {
+		entries = append(entries, openLibraryEntry{Title: "Book " + strconv.Itoa(i), Key: "/works/OL" + strconv.Itoa(i) + "W"})
+	}
+
+	standIn := &openLibraryStandIn{
+		pageSize: 3,
+		users: map[string]map[string][]openLibraryEntry{
+			"reader": {"already-read": entries},
+		},
+	}
+	ol := newOpenLibraryTest(t, standIn)
+
+	bs, err := listOpenLibraryBooks(ol, "username=reader&shelf=already-read")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bs) != len(entries) {
+		t.Fatalf("got %d books, want %d", len(bs), len(entries))
+	}
+
+	for i, b := range bs {
+		if b.Title != entries[i].Title {
+			t.Errorf("book %d: got title %q, want %q", i, b.Title, entries[i].Title)
+		}
+	}
+
+	// XXX 7 entries, 3 per page: the third page is short, so there's no need for a fourth
+	for page := 1; page <= 3; page++ {
+		if n := standIn.requests[fmt.Sprintf("reader/already-read/%d", page)]; n != 1 {
+			t.Errorf("page %d requested %d times, want 1", page, n)
+		}
+	}
+
+	if n := standIn.requests["reader/already-read/4"]; n != 0 {
+		t.Errorf("page 4 requested %d times, want 0", n)
+	}
+}
+
+func TestOpenLibraryEmptyShelves(t *testing.T) {
+	standIn := &openLibraryStandIn{
+		pageSize: 3,
+		users:    map[string]map[string][]openLibraryEntry{"reader": {}},
+	}
+	ol := newOpenLibraryTest(t, standIn)
+
+	bs, err := listOpenLibraryBooks(ol, "username=reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bs) != 0 {
+		t.Errorf("got %d books, want none", len(bs))
+	}
+
+	for _, shelf := range openLibraryShelves {
+		if n := standIn.requests["reader/"+shelf+"/1"]; n != 1 {
+			t.Errorf("shelf %s requested %d times, want 1", shelf, n)
+		}
+	}
+}
+
+func TestOpenLibraryErrors(t *testing.T) {
+	standIn := &openLibraryStandIn{
+		pageSize: 3,
+		users:    map[string]map[string][]openLibraryEntry{},
+		statuses: map[string]int{
+			"private": http.StatusForbidden,
+			"broken":  http.StatusInternalServerError,
+		},
+	}
+	ol := newOpenLibraryTest(t, standIn)
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"unknown user", "username=nobody", http.StatusNotFound},
+		{"private reading log", "username=private", http.StatusForbidden},
+		{"server error", "username=broken", http.StatusBadGateway},
+		{"invalid username", "username=no%20spaces", http.StatusBadRequest},
+		{"invalid shelf", "username=nobody&shelf=favorites", http.StatusBadRequest},
+		{"no username", "", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := listOpenLibraryBooks(ol, test.query)
+			if err == nil {
+				t.Fatal("got no error")
+			}
+
+			appErr, ok := err.(*app.Error)
+			if !ok {
+				t.Fatalf("got %T (%v), want an *app.Error", err, err)
+			}
+
+			if appErr.Status != test.status {
+				t.Errorf("got status %d (%s), want %d", appErr.Status, appErr.Message, test.status)
+			}
+		})
+	}
+}
+
+func TestOpenLibraryBookMapping(t *testing.T) {
+	standIn := &openLibraryStandIn{
+		pageSize: 10,
+		users: map[string]map[string][]openLibraryEntry{
+			"reader": {
+				"want-to-read":      {{"Dune", "/works/OL893415W", []string{"Frank Herbert"}}},
+				"currently-reading": {{"Good Omens", "/works/OL453936W", []string{"Terry Pratchett", "Neil Gaiman"}}},
+			},
+		},
+	}
+	ol := newOpenLibraryTest(t, standIn)
+
+	bs, err := listOpenLibraryBooks(ol, "username=reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := libris.Books{
+		{
+			Title:          "Dune",
+			Authors:        []string{"Frank Herbert"},
+			Identifier:     "OL893415W",
+			IdentifierType: "OPEN_LIBRARY",
+			Shelf:          "want-to-read",
+		},
+		{
+			Title:          "Good Omens",
+			Authors:        []string{"Terry Pratchett", "Neil Gaiman"},
+			Identifier:     "OL453936W",
+			IdentifierType: "OPEN_LIBRARY",
+			Shelf:          "currently-reading",
+		},
+	}
+
+	if !reflect.DeepEqual(bs, want) {
+		got, _ := json.Marshal(bs)
+		expected, _ := json.Marshal(want)
+		t.Errorf("got %s, want %s", got, expected)
+	}
+}
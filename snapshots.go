@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/hanjos/mea-libris/app"
+)
+
+// snapshotTaker periodically takes a snapshot of the Google books of every account connected to Google, as listed by
+// default, so /google/changes can tell what changed even if the books weren't fetched in the meantime.
+type snapshotTaker struct {
+	goog      *googleProvider
+	snapshots app.SnapshotStore
+	interval  time.Duration
+	timeout   time.Duration
+}
+
+func newSnapshotTaker(goog *googleProvider, snapshots app.SnapshotStore, interval, timeout time.Duration) *snapshotTaker {
+	return &snapshotTaker{
+		goog:      goog,
+		snapshots: snapshots,
+		interval:  interval,
+		timeout:   timeout,
+	}
+}
+
+// Run takes snapshots right away, and then every interval, until ctx is done. Everything it logs is tagged with
+// job=snapshots.
+func (st *snapshotTaker) Run(ctx context.Context) {
+	ctx = app.WithLogger(ctx, logFrom(ctx).WithField("job", "snapshots"))
+
+	for {
+		st.takeAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(st.interval):
+		}
+	}
+}
+
+// takeAll takes a snapshot of the books of every account connected to Google, one at a time.
+func (st *snapshotTaker) takeAll(ctx context.Context) {
+	all, err := accounts.List()
+	if err != nil {
+		logFrom(ctx).Error(errCantTakeSnapshot("every account", errCantLoadAccount(err)))
+		return
+	}
+
+	for _, a := range all {
+		if ctx.Err() != nil {
+			return
+		} else if a.Connections[st.goog.Name()] == "" {
+			continue
+		}
+
+		if err := st.take(ctx, a); err != nil {
+			logFrom(ctx).Error(errCantTakeSnapshot(a.Username, err))
+		}
+	}
+}
+
+// take fetches the account's books and records them, as /google/changes would without query parameters.
+func (st *snapshotTaker) take(ctx context.Context, a *app.Account) error {
+	if st.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, st.timeout)
+		defer cancel()
+	}
+
+	bs, err := st.goog.accountBooks(ctx, a)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := st.snapshots.Record(snapshotUser(a, defaultGoogleBooksQuery()), bs)
+	if err != nil {
+		return errCantRecordSnapshot(err)
+	}
+
+	logFrom(ctx).Debugf("Took snapshot %s of the books of %s", snapshot.ID, a.Username)
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serviceName is what this server is called in traces, unless OTEL_SERVICE_NAME says otherwise.
+const serviceName = "mea-libris"
+
+// tracer starts the spans of this package. They go nowhere until newTracerProvider is called.
+var tracer = otel.Tracer("github.com/hanjos/mea-libris")
+
+// otlpTracesURL returns where the OTLP/HTTP collector at endpoint, a base URL like http://localhost:4318, takes traces.
+func otlpTracesURL(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errInvalidOTLPEndpoint(endpoint)
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/traces"
+	return u.String(), nil
+}
+
+// newTracerProvider sets up tracing: spans are batched and exported to the OTLP/HTTP collector at endpoint, and trace
+// context is read from and passed on in W3C traceparent headers. The provider should be shut down before exiting, so
+// the last spans are sent.
+func newTracerProvider(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	tracesURL, err := otlpTracesURL(endpoint)
+	if err != nil {
+		return nil, errCantTrace(err)
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(tracesURL))
+	if err != nil {
+		return nil, errCantTrace(err)
+	}
+
+	// XXX FromEnv comes last, so OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES win
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv())
+	if err != nil {
+		return nil, errCantTrace(err)
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return tp, nil
+}
+
+// withTracing starts a span for every request h serves, named after the method and the mux route it matched, as a
+// child of the trace in the request's traceparent header, if any. Scrapes of /metrics aren't traced.
+func withTracing(mux *http.ServeMux, h http.Handler) http.Handler {
+	return otelhttp.NewHandler(h, serviceName,
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			_, route := mux.Handler(r)
+			return r.Method + " " + defaultTo(route, "none")
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return r.URL.Path != "/metrics"
+		}))
+}
+
+// tracingTransport starts a client span for every request base makes, and passes the trace on in a traceparent header.
+func tracingTransport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base)
+}
+
+// startSpan starts a span with the given name and attributes, as a child of whichever span ctx carries.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span, marking it as failed if err isn't nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
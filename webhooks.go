@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hanjos/mea-libris/app"
+	"github.com/hanjos/mea-libris/libris"
+)
+
+// webhookEvent is the only event sent to webhooks so far.
+const webhookEvent = "books.changed"
+
+// maxWebhooks is how many webhooks an account may have.
+const maxWebhooks = 10
+
+// webhookWatcher periodically fetches the Google books of every account with webhooks, and tells them what changed
+// since the previous time. Each account's books are compared with a snapshot of their own, so what users fetch in the
+// meantime doesn't hide any changes.
+type webhookWatcher struct {
+	goog      *googleProvider
+	sender    *app.WebhookSender
+	snapshots app.SnapshotStore
+	interval  time.Duration
+	timeout   time.Duration
+}
+
+// webhookPayload is what webhooks receive when the account's books change.
+type webhookPayload struct {
+	Event    string    `json:"event"`
+	Account  string    `json:"account"`
+	Provider string    `json:"provider"`
+	Since    string    `json:"since"`
+	Snapshot string    `json:"snapshot"`
+	Taken    time.Time `json:"taken"`
+	*libris.Changes
+}
+
+func newWebhookWatcher(goog *googleProvider, sender *app.WebhookSender, snapshots app.SnapshotStore, interval, timeout time.Duration) *webhookWatcher {
+	return &webhookWatcher{
+		goog:      goog,
+		sender:    sender,
+		snapshots: snapshots,
+		interval:  interval,
+		timeout:   timeout,
+	}
+}
+
+// Run polls right away, and then every interval, until ctx is done. Deliveries are cancelled along with ctx.
+// Everything it logs, deliveries included, is tagged with job=webhooks.
+func (ww *webhookWatcher) Run(ctx context.Context) {
+	ctx = app.WithLogger(ctx, logFrom(ctx).WithField("job", "webhooks"))
+
+	for {
+		ww.pollAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ww.interval):
+		}
+	}
+}
+
+// pollAll polls every account with webhooks and a connection to Google, one at a time.
+func (ww *webhookWatcher) pollAll(ctx context.Context) {
+	all, err := accounts.List()
+	if err != nil {
+		logFrom(ctx).Error(errCantPollBooks("every account", errCantLoadAccount(err)))
+		return
+	}
+
+	for _, a := range all {
+		if ctx.Err() != nil {
+			return
+		} else if len(a.Webhooks) == 0 || a.Connections[ww.goog.Name()] == "" {
+			continue
+		}
+
+		if err := ww.poll(ctx, a); err != nil {
+			logFrom(ctx).Error(errCantPollBooks(a.Username, err))
+		}
+	}
+}
+
+// poll fetches the account's books and, if they changed since the previous poll, sends the changes to every one of
+// its webhooks. The first poll only takes a snapshot, since there's nothing to compare with.
+func (ww *webhookWatcher) poll(ctx context.Context, a *app.Account) error {
+	fetchCtx := ctx
+	if ww.timeout > 0 {
+		var cancel context.CancelFunc
+		fetchCtx, cancel = context.WithTimeout(ctx, ww.timeout)
+		defer cancel()
+	}
+
+	bs, err := ww.goog.accountBooks(fetchCtx, a)
+	if err != nil {
+		return err
+	}
+
+	user := "webhooks " + a.ID
+	previous, ok, err := ww.snapshots.At(user, time.Now())
+	if err != nil {
+		return errCantLoadSnapshot(err)
+	}
+
+	latest, err := ww.snapshots.Record(user, bs)
+	if err != nil {
+		return errCantRecordSnapshot(err)
+	} else if !ok || latest.ID == previous.ID {
+		return nil
+	}
+
+	changes := libris.Diff(previous.Books, latest.Books, googleVolumeID)
+	if changes.IsEmpty() {
+		return nil // XXX only books without a volume ID changed, which can't be told apart
+	}
+
+	payload, err := json.Marshal(webhookPayload{
+		Event:    webhookEvent,
+		Account:  a.Username,
+		Provider: ww.goog.Name(),
+		Since:    previous.ID,
+		Snapshot: latest.ID,
+		Taken:    latest.Taken,
+		Changes:  changes,
+	})
+	if err != nil {
+		return err
+	}
+
+	logFrom(ctx).Infof("Books changed for %s (%d added, %d removed, %d modified); notifying %d webhooks", a.Username,
+		len(changes.Added), len(changes.Removed), len(changes.Modified), len(a.Webhooks))
+	for _, hook := range a.Webhooks {
+		ww.sender.Send(ctx, randomID()[:12], hook, webhookEvent, payload)
+	}
+
+	return nil
+}
+
+// webhookJSON is how webhooks are shown. The secret is only there right after the webhook is created.
+type webhookJSON struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Secret  string    `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// HandleWebhooks lists the current account's webhooks on GET, and creates one on POST, with the url in the form. The
+// new webhook's secret, with which its payloads are signed, is only shown in the response.
+func (as *accountService) HandleWebhooks(w http.ResponseWriter, r *http.Request) *app.Error {
+	if as.webhooks == nil {
+		return app.Wrap(errWebhooksDisabled, http.StatusNotFound)
+	}
+
+	a, ok := currentAccount(r)
+	if !ok {
+		return app.Wrap(errNotLoggedIn, http.StatusUnauthorized)
+	}
+
+	switch r.Method {
+	case "GET":
+		hooks := []webhookJSON{}
+		for _, hook := range a.Webhooks {
+			hooks = append(hooks, webhookJSON{ID: hook.ID, URL: hook.URL, Created: hook.Created})
+		}
+
+		return writeJSON(w, http.StatusOK, hooks)
+	case "POST":
+		if err := checkCSRFToken(r); err != nil {
+			return app.Wrap(err, http.StatusForbidden)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		return app.Wrap(errMethodNotAllowed(r.Method), http.StatusMethodNotAllowed)
+	}
+
+	rawURL := strings.TrimSpace(r.PostFormValue("url"))
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return app.Wrap(errInvalidWebhookURL(rawURL), http.StatusBadRequest)
+	} else if len(a.Webhooks) >= maxWebhooks {
+		return app.Wrap(errTooManyWebhooks, http.StatusConflict)
+	}
+
+	hook := app.Webhook{
+		ID:      randomID()[:12],
+		URL:     rawURL,
+		Secret:  randomID(),
+		Created: time.Now(),
+	}
+
+	ok, err := accounts.Update(a.ID, func(a *app.Account) {
+		a.Webhooks = append(a.Webhooks, hook)
+	})
+	if err != nil {
+		return app.Wrap(errCantSaveAccount(err), http.StatusInternalServerError)
+	} else if !ok {
+		return app.Wrap(errNotLoggedIn, http.StatusUnauthorized)
+	}
+
+	logFrom(r.Context()).Infof("Webhook %s created for %s", hook.ID, a.Username)
+	return writeJSON(w, http.StatusCreated, webhookJSON{ID: hook.ID, URL: hook.URL, Secret: hook.Secret, Created: hook.Created})
+}
+
+// HandleDeleteWebhook deletes the current account's webhook with the id in the POSTed form, giving up on its pending
+// deliveries.
+func (as *accountService) HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) *app.Error {
+	if as.webhooks == nil {
+		return app.Wrap(errWebhooksDisabled, http.StatusNotFound)
+	} else if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return app.Wrap(errMethodNotAllowed(r.Method), http.StatusMethodNotAllowed)
+	} else if err := checkCSRFToken(r); err != nil {
+		return app.Wrap(err, http.StatusForbidden)
+	}
+
+	a, ok := currentAccount(r)
+	if !ok {
+		return app.Wrap(errNotLoggedIn, http.StatusUnauthorized)
+	}
+
+	id, deleted := r.PostFormValue("id"), false
+	_, err := accounts.Update(a.ID, func(a *app.Account) {
+		for i, hook := range a.Webhooks {
+			if hook.ID == id {
+				a.Webhooks = append(a.Webhooks[:i], a.Webhooks[i+1:]...)
+				deleted = true
+				return
+			}
+		}
+	})
+	if err != nil {
+		return app.Wrap(errCantSaveAccount(err), http.StatusInternalServerError)
+	} else if !deleted {
+		return app.Wrap(errWebhookNotFound(id), http.StatusNotFound)
+	}
+
+	as.webhooks.Forget(id)
+
+	logFrom(r.Context()).Infof("Webhook %s deleted for %s", id, a.Username)
+	fmt.Fprintln(w, "Webhook deleted!")
+	return nil
+}
+
+// HandleWebhookDeliveries lists the latest deliveries to the current account's webhooks, newest first, with every
+// attempt made. The webhook parameter narrows them down to a single webhook.
+func (as *accountService) HandleWebhookDeliveries(w http.ResponseWriter, r *http.Request) *app.Error {
+	if as.webhooks == nil {
+		return app.Wrap(errWebhooksDisabled, http.StatusNotFound)
+	}
+
+	a, ok := currentAccount(r)
+	if !ok {
+		return app.Wrap(errNotLoggedIn, http.StatusUnauthorized)
+	}
+
+	var ids []string
+	wanted := r.URL.Query().Get("webhook")
+	for _, hook := range a.Webhooks {
+		if wanted == "" || hook.ID == wanted {
+			ids = append(ids, hook.ID)
+		}
+	}
+
+	if wanted != "" && len(ids) == 0 {
+		return app.Wrap(errWebhookNotFound(wanted), http.StatusNotFound)
+	}
+
+	return writeJSON(w, http.StatusOK, as.webhooks.Deliveries(ids...))
+}